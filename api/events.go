@@ -0,0 +1,159 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	eventWriteTimeout = 10 * time.Second
+	eventPingInterval = 30 * time.Second
+)
+
+type eventResponse struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+type trackEventData struct {
+	Track      *trackResponse `json:"track,omitempty"`
+	Index      *int           `json:"index,omitempty"`
+	PositionMs *int64         `json:"position_ms,omitempty"`
+}
+
+type queueEventData struct {
+	Length int `json:"length"`
+}
+
+type commandEventData struct {
+	Sender  string   `json:"sender"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Result  string   `json:"result"`
+}
+
+type errorEventData struct {
+	Track *trackResponse `json:"track,omitempty"`
+	Error string         `json:"error"`
+}
+
+func trackEvent(data *trackResponse, position *time.Duration) trackEventData {
+	event := trackEventData{Track: data}
+	if position != nil {
+		ms := position.Milliseconds()
+		event.PositionMs = &ms
+	}
+	return event
+}
+
+func eventFromBotEvent(event bot.Event) eventResponse {
+	response := eventResponse{Type: event.EventName(), Time: time.Now()}
+	switch e := event.(type) {
+	case bot.TrackStartedEvent:
+		track := trackFromAudioData(e.Track)
+		data := trackEvent(&track, &e.Offset)
+		data.Index = &e.Index
+		response.Data = data
+	case bot.TrackFinishedEvent:
+		track := trackFromAudioData(e.Track)
+		response.Data = trackEvent(&track, nil)
+	case bot.TrackSkippedEvent:
+		track := trackFromAudioData(e.Track)
+		response.Data = trackEvent(&track, nil)
+	case bot.PausedEvent:
+		track := trackFromAudioData(e.Track)
+		response.Data = trackEvent(&track, &e.Position)
+	case bot.ResumedEvent:
+		track := trackFromAudioData(e.Track)
+		response.Data = trackEvent(&track, &e.Position)
+	case bot.QueueChangedEvent:
+		response.Data = queueEventData{Length: e.Length}
+	case bot.ModeChangedEvent:
+		response.Data = modeResponse{Mode: bot.PlaybackModeToString(e.Mode)}
+	case bot.CommandIssuedEvent:
+		response.Data = commandEventData{Sender: e.Sender, Command: e.Command, Args: e.Args, Result: string(e.Result)}
+	case bot.PlaybackErrorEvent:
+		data := errorEventData{Error: e.Err.Error()}
+		if e.Track != nil {
+			track := trackFromAudioData(e.Track)
+			data.Track = &track
+		}
+		response.Data = data
+	default:
+		response.Data = struct{}{}
+	}
+	return response
+}
+
+// the token can be in the query, so a page on another site must not be able to open the stream
+// with a token it got hold of, only the web interface itself and origins set with SetAllowedOrigins can
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not a browser
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.Contains(s.allowedOrigins, origin)
+}
+
+// sends the current status first, then every event as it happens
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already written an error response
+		return
+	}
+	defer conn.Close()
+
+	events, unsubscribe := s.mp.Events().Subscribe()
+	defer unsubscribe()
+
+	// nothing is expected from the client, but reading is how a close gets noticed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(v any) bool {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		return conn.WriteJSON(v) == nil
+	}
+	if !write(eventResponse{Type: "status", Time: time.Now(), Data: s.status()}) {
+		return
+	}
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case event, ok := <-events:
+			if !ok || !write(eventFromBotEvent(event)) {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteTimeout)); err != nil {
+				log.Println("Event stream ping failed: ", err)
+				return
+			}
+		}
+	}
+}
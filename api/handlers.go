@@ -0,0 +1,290 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/media"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// limit and offset query parameters, both optional
+func pageParams(r *http.Request) (int, int, bool) {
+	limit, offset := defaultPageLimit, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		limit = min(n, maxPageLimit)
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+func (s *Server) listTracks(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pageParams(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid limit or offset.")
+		return
+	}
+	var total int64
+	if err := s.db.Model(&media.AudioData{}).Count(&total).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error while fetching tracks.")
+		return
+	}
+	var tracks []media.AudioData
+	if err := s.db.Order("id").Limit(limit).Offset(offset).Find(&tracks).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error while fetching tracks.")
+		return
+	}
+	writeJSON(w, http.StatusOK, trackListResponse{Tracks: tracksFromAudioData(tracks), Total: total})
+}
+
+func (s *Server) searchTracks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeError(w, http.StatusBadRequest, "Search query needed.")
+		return
+	}
+	limit, offset, ok := pageParams(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid limit or offset.")
+		return
+	}
+	tracks, total, err := media.SearchAudioData(s.db, query, limit, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error while searching tracks.")
+		return
+	}
+	writeJSON(w, http.StatusOK, trackListResponse{Tracks: tracksFromAudioData(tracks), Total: total})
+}
+
+func (s *Server) getTrack(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid track ID.")
+		return
+	}
+	var track media.AudioData
+	if err := s.db.First(&track, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, http.StatusNotFound, "Invalid track ID.")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error while fetching track.")
+		return
+	}
+	writeJSON(w, http.StatusOK, trackFromAudioData(&track))
+}
+
+// thumbnails are named after the hash of the picture, so they never change
+func (s *Server) getCover(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 16 {
+		writeError(w, http.StatusBadRequest, "Invalid cover art hash.")
+		return
+	}
+	if s.covers == nil {
+		writeError(w, http.StatusNotFound, "Cover art not found.")
+		return
+	}
+	data, err := os.ReadFile(s.covers.Path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "Cover art not found.")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to read cover art.")
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Write(data)
+}
+
+func (s *Server) queue() queueResponse {
+	playlist := s.mp.GetPlaylist()
+	tracks := make([]trackResponse, 0, len(playlist))
+	for _, t := range playlist {
+		tracks = append(tracks, trackFromAudioData(t))
+	}
+	return queueResponse{Tracks: tracks, CurrentIndex: s.mp.GetCurrentIndex()}
+}
+
+func (s *Server) getQueue(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.queue())
+}
+
+func (s *Server) addToQueue(w http.ResponseWriter, r *http.Request) {
+	var req addRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	ids := req.TrackIDs
+	if req.TrackID != 0 {
+		ids = append([]uint{req.TrackID}, ids...)
+	}
+	if len(ids) == 0 {
+		writeError(w, http.StatusBadRequest, "Track ID needed.")
+		return
+	}
+	tracks, err := media.FindAudioDataByIds(s.db, ids)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error while fetching tracks.")
+		return
+	}
+	if len(tracks) != len(ids) {
+		writeError(w, http.StatusNotFound, "Invalid track ID.")
+		return
+	}
+	s.mp.AddAllToPlaylist(tracks)
+	writeJSON(w, http.StatusOK, s.queue())
+}
+
+func (s *Server) removeFromQueue(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid playlist index.")
+		return
+	}
+	switch _, result := s.mp.RemoveFromPlaylist(index); result {
+	case bot.OutOfRange:
+		writeError(w, http.StatusNotFound, "Playlist index out of range.")
+		return
+	case bot.Playing:
+		writeError(w, http.StatusConflict, "You can't remove the track that's currently playing.")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.queue())
+}
+
+func (s *Server) moveInQueue(w http.ResponseWriter, r *http.Request) {
+	var req moveRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	if err := s.mp.MoveInPlaylist(req.From, req.To); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.queue())
+}
+
+func (s *Server) clearQueue(w http.ResponseWriter, r *http.Request) {
+	s.mp.ClearPlaylist()
+	writeJSON(w, http.StatusOK, s.queue())
+}
+
+func (s *Server) status() statusResponse {
+	status := statusResponse{
+		Paused:      s.mp.IsPaused(),
+		Mode:        bot.PlaybackModeToString(s.mp.GetMode()),
+		Volume:      s.mp.GetVolume(),
+		QueueLength: len(s.mp.GetPlaylist()),
+	}
+	if current := s.mp.GetCurrentTrack(); current != nil {
+		track := trackFromAudioData(current)
+		status.Playing = true
+		status.Track = &track
+		if position, err := s.mp.GetPosition(); err == nil {
+			ms := position.Milliseconds()
+			status.PositionMs = &ms
+		}
+	}
+	return status
+}
+
+func (s *Server) getStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+func (s *Server) start(w http.ResponseWriter, r *http.Request) {
+	if len(s.mp.GetPlaylist()) == 0 {
+		writeError(w, http.StatusConflict, "Playlist is empty.")
+		return
+	}
+	if s.mp.IsPaused() {
+		s.mp.Unpause()
+	} else if s.mp.GetCurrentTrack() == nil {
+		s.mp.StartPlaylist()
+	}
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+func (s *Server) stop(w http.ResponseWriter, r *http.Request) {
+	s.mp.StopPlaylist()
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+func (s *Server) pause(w http.ResponseWriter, r *http.Request) {
+	if err := s.mp.Pause(); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+func (s *Server) resume(w http.ResponseWriter, r *http.Request) {
+	if err := s.mp.Unpause(); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+func (s *Server) skip(w http.ResponseWriter, r *http.Request) {
+	if err := s.mp.Skip(); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, messageResponse{Message: "Skipping track."})
+}
+
+func (s *Server) seek(w http.ResponseWriter, r *http.Request) {
+	var req seekRequest
+	if err := readJSON(r, &req); err != nil || req.PositionMs < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	if err := s.mp.Seek(time.Duration(req.PositionMs) * time.Millisecond); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+func (s *Server) getMode(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, modeResponse{Mode: bot.PlaybackModeToString(s.mp.GetMode())})
+}
+
+func (s *Server) setMode(w http.ResponseWriter, r *http.Request) {
+	var req modeRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	mode, ok := bot.ParsePlaybackMode(req.Mode)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid playback mode: "+req.Mode)
+		return
+	}
+	s.mp.SetMode(mode)
+	writeJSON(w, http.StatusOK, modeResponse{Mode: bot.PlaybackModeToString(mode)})
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/media"
+	"gorm.io/gorm"
+)
+
+var ErrEmptyToken = errors.New("API token cannot be empty.")
+
+type Server struct {
+	mp             *bot.MusicPlayer
+	db             *gorm.DB
+	token          string
+	covers         *media.CoverCache
+	allowedOrigins []string
+	mux            *http.ServeMux
+	server         *http.Server
+}
+
+func CreateServer(addr, token string, mp *bot.MusicPlayer, db *gorm.DB) (*Server, error) {
+	if token == "" {
+		return nil, ErrEmptyToken
+	}
+	s := &Server{mp: mp, db: db, token: token, mux: http.NewServeMux()}
+	s.registerRoutes()
+	s.server = &http.Server{Addr: addr, Handler: s.mux}
+	return s, nil
+}
+
+func (s *Server) registerRoutes() {
+	s.HandleAPI("GET /api/tracks", s.listTracks)
+	s.HandleAPI("GET /api/tracks/search", s.searchTracks)
+	s.HandleAPI("GET /api/tracks/{id}", s.getTrack)
+
+	s.HandleAPI("GET /api/queue", s.getQueue)
+	s.HandleAPI("POST /api/queue", s.addToQueue)
+	s.HandleAPI("DELETE /api/queue/{index}", s.removeFromQueue)
+	s.HandleAPI("POST /api/queue/move", s.moveInQueue)
+	s.HandleAPI("DELETE /api/queue", s.clearQueue)
+
+	s.HandleAPI("GET /api/status", s.getStatus)
+	s.HandleAPI("POST /api/playback/start", s.start)
+	s.HandleAPI("POST /api/playback/stop", s.stop)
+	s.HandleAPI("POST /api/playback/pause", s.pause)
+	s.HandleAPI("POST /api/playback/resume", s.resume)
+	s.HandleAPI("POST /api/playback/skip", s.skip)
+	s.HandleAPI("POST /api/playback/seek", s.seek)
+
+	s.HandleAPI("GET /api/mode", s.getMode)
+	s.HandleAPI("PUT /api/mode", s.setMode)
+
+	s.HandleAPI("GET /api/covers/{hash}", s.getCover)
+
+	// browsers can't set headers on WebSockets, so only the event stream takes the token in the query
+	s.mux.Handle("GET /api/events", s.requireToken(http.HandlerFunc(s.streamEvents), true))
+}
+
+// pages on these origins (like https://example.com) can open the event stream besides the web interface
+func (s *Server) SetAllowedOrigins(origins []string) {
+	s.allowedOrigins = origins
+}
+
+func (s *Server) SetCoverCache(cache *media.CoverCache) {
+	s.covers = cache
+}
+
+// for endpoints that need the token
+func (s *Server) HandleAPI(pattern string, handler http.HandlerFunc) {
+	s.mux.Handle(pattern, s.requireToken(handler, false))
+}
+
+// for anything that should be reachable without the token, like static files
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+func (s *Server) ListenAndServe() error {
+	return s.server.ListenAndServe()
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// the token goes in an Authorization: Bearer header, or the token query parameter if allowQuery is set
+func (s *Server) requireToken(next http.Handler, allowQuery bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = ""
+			if allowQuery {
+				token = r.URL.Query().Get("token")
+			}
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "Missing or invalid API token.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to write API response: ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
+
+func readJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
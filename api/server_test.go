@@ -0,0 +1,334 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/internal/testutil"
+	"github.com/EricZhang456/mumble-music-bot/media"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+const testToken = "secret"
+
+type testServer struct {
+	*httptest.Server
+	db     *gorm.DB
+	mp     *bot.MusicPlayer
+	covers *media.CoverCache
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	duration := 3 * time.Minute
+	player := testutil.NewPlayer(t,
+		media.AudioData{Path: "/music/a.flac", Title: "Alpha", Artists: testutil.StrPtr("First Band"), Album: testutil.StrPtr("Letters"), Duration: &duration},
+		media.AudioData{Path: "/music/b.flac", Title: "Bravo", Artists: testutil.StrPtr("First Band"), Album: testutil.StrPtr("Letters")},
+		media.AudioData{Path: "/music/c.flac", Title: "Charlie", Artists: testutil.StrPtr("Second Band")},
+	)
+	db, mp := player.DB, player.MusicPlayer
+
+	covers, err := media.CreateCoverCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := CreateServer("", testToken, mp, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetCoverCache(covers)
+	ts := &testServer{Server: httptest.NewServer(s.Handler()), db: db, mp: mp, covers: covers}
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// body is encoded as JSON unless it's nil, the response is decoded into out unless it's nil
+func (ts *testServer) do(t *testing.T, method, path string, body any, out any) int {
+	t.Helper()
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, ts.URL+path, &reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func queueTitles(queue queueResponse) []string {
+	titles := make([]string, 0, len(queue.Tracks))
+	for _, t := range queue.Tracks {
+		titles = append(titles, t.Title)
+	}
+	return titles
+}
+
+func TestCreateServerNeedsToken(t *testing.T) {
+	if _, err := CreateServer("", "", nil, nil); err != ErrEmptyToken {
+		t.Fatalf("expected ErrEmptyToken, got %v", err)
+	}
+}
+
+func TestRequiresToken(t *testing.T) {
+	ts := newTestServer(t)
+	for _, header := range []string{"", "Bearer wrong", testToken} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/status", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected 401, got %d", header, resp.StatusCode)
+		}
+	}
+	if status := ts.do(t, http.MethodGet, "/api/status", nil, nil); status != http.StatusOK {
+		t.Errorf("expected 200 with the token, got %d", status)
+	}
+}
+
+func TestListTracks(t *testing.T) {
+	ts := newTestServer(t)
+	var list trackListResponse
+	if status := ts.do(t, http.MethodGet, "/api/tracks?limit=2&offset=1", nil, &list); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if list.Total != 3 || len(list.Tracks) != 2 || list.Tracks[0].Title != "Bravo" {
+		t.Errorf("unexpected page: %+v", list)
+	}
+	if status := ts.do(t, http.MethodGet, "/api/tracks?limit=zero", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad limit, got %d", status)
+	}
+}
+
+func TestGetTrack(t *testing.T) {
+	ts := newTestServer(t)
+	var track trackResponse
+	if status := ts.do(t, http.MethodGet, "/api/tracks/1", nil, &track); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if track.Title != "Alpha" || track.DurationMs == nil || *track.DurationMs != 180000 {
+		t.Errorf("unexpected track: %+v", track)
+	}
+	if status := ts.do(t, http.MethodGet, "/api/tracks/42", nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", status)
+	}
+	if status := ts.do(t, http.MethodGet, "/api/tracks/abc", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", status)
+	}
+}
+
+func TestSearchTracks(t *testing.T) {
+	ts := newTestServer(t)
+	// the index is filled from the tracks that are already there
+	if err := media.MigrateSearchIndex(ts.db); err != nil {
+		t.Skip("SQLite was built without FTS5, run with -tags sqlite_fts5: ", err)
+	}
+	var list trackListResponse
+	if status := ts.do(t, http.MethodGet, "/api/tracks/search?q=first", nil, &list); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if list.Total != 2 {
+		t.Errorf("expected 2 results, got %+v", list)
+	}
+	if status := ts.do(t, http.MethodGet, "/api/tracks/search", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("expected 400 without a query, got %d", status)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	ts := newTestServer(t)
+	var queue queueResponse
+	if status := ts.do(t, http.MethodPost, "/api/queue", addRequest{TrackIDs: []uint{1, 2, 3}}, &queue); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if len(queue.Tracks) != 3 || queue.CurrentIndex != -1 {
+		t.Fatalf("unexpected queue after adding: %+v", queue)
+	}
+
+	if status := ts.do(t, http.MethodPost, "/api/queue/move", moveRequest{From: 0, To: 2}, &queue); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if titles := queueTitles(queue); fmt.Sprint(titles) != "[Bravo Charlie Alpha]" {
+		t.Errorf("unexpected order after moving: %v", titles)
+	}
+
+	if status := ts.do(t, http.MethodDelete, "/api/queue/0", nil, &queue); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if titles := queueTitles(queue); fmt.Sprint(titles) != "[Charlie Alpha]" {
+		t.Errorf("unexpected order after removing: %v", titles)
+	}
+
+	if status := ts.do(t, http.MethodDelete, "/api/queue/5", nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 removing past the end, got %d", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/api/queue/move", moveRequest{From: 0, To: 9}, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 moving past the end, got %d", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/api/queue", addRequest{TrackID: 42}, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 adding an unknown track, got %d", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/api/queue", map[string]any{"bogus": 1}, nil); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown field, got %d", status)
+	}
+
+	if status := ts.do(t, http.MethodDelete, "/api/queue", nil, &queue); status != http.StatusOK || len(queue.Tracks) != 0 {
+		t.Errorf("expected an empty queue after clearing, got %d %+v", status, queue)
+	}
+}
+
+func TestTransportWhileStopped(t *testing.T) {
+	ts := newTestServer(t)
+	if status := ts.do(t, http.MethodPost, "/api/playback/start", nil, nil); status != http.StatusConflict {
+		t.Errorf("start with an empty queue: expected 409, got %d", status)
+	}
+	for _, path := range []string{"/api/playback/skip", "/api/playback/pause", "/api/playback/resume"} {
+		if status := ts.do(t, http.MethodPost, path, nil, nil); status != http.StatusConflict {
+			t.Errorf("%s while stopped: expected 409, got %d", path, status)
+		}
+	}
+	if status := ts.do(t, http.MethodPost, "/api/playback/seek", seekRequest{PositionMs: 1000}, nil); status != http.StatusConflict {
+		t.Errorf("seek while stopped: expected 409, got %d", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/api/playback/seek", seekRequest{PositionMs: -1}, nil); status != http.StatusBadRequest {
+		t.Errorf("negative seek: expected 400, got %d", status)
+	}
+
+	var status statusResponse
+	if code := ts.do(t, http.MethodPost, "/api/playback/stop", nil, &status); code != http.StatusOK {
+		t.Fatalf("stop: expected 200, got %d", code)
+	}
+	if status.Playing || status.Track != nil || status.Mode != "Single" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestMode(t *testing.T) {
+	ts := newTestServer(t)
+	var mode modeResponse
+	if status := ts.do(t, http.MethodPut, "/api/mode", modeRequest{Mode: "shufflerepeat"}, &mode); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if mode.Mode != "ShuffleRepeat" || ts.mp.GetMode() != bot.ShuffleRepeat {
+		t.Errorf("mode was not changed: %+v", mode)
+	}
+	if status := ts.do(t, http.MethodGet, "/api/mode", nil, &mode); status != http.StatusOK || mode.Mode != "ShuffleRepeat" {
+		t.Errorf("unexpected mode: %d %+v", status, mode)
+	}
+	if status := ts.do(t, http.MethodPut, "/api/mode", modeRequest{Mode: "backwards"}, nil); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown mode, got %d", status)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	ts := newTestServer(t)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/events"
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Fatal("expected the event stream to need a token")
+	}
+	if _, _, err := websocket.DefaultDialer.Dial(url+"?token="+testToken, http.Header{"Origin": {"https://elsewhere.example"}}); err == nil {
+		t.Fatal("expected the event stream to refuse other origins")
+	}
+	sameOrigin, _, err := websocket.DefaultDialer.Dial(url+"?token="+testToken, http.Header{"Origin": {ts.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameOrigin.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token="+testToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	read := func() map[string]any {
+		t.Helper()
+		var event map[string]any
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	if event := read(); event["type"] != "status" {
+		t.Fatalf("expected a status event first, got %v", event)
+	}
+
+	ts.do(t, http.MethodPost, "/api/queue", addRequest{TrackIDs: []uint{1, 2}}, nil)
+	event := read()
+	if event["type"] != "queue_changed" || event["data"].(map[string]any)["length"] != float64(2) {
+		t.Errorf("unexpected event: %v", event)
+	}
+	ts.do(t, http.MethodPut, "/api/mode", modeRequest{Mode: "repeat"}, nil)
+	event = read()
+	if event["type"] != "mode_changed" || event["data"].(map[string]any)["mode"] != "Repeat" {
+		t.Errorf("unexpected event: %v", event)
+	}
+}
+
+func TestCover(t *testing.T) {
+	ts := newTestServer(t)
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := ts.covers.Store(picture.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the event stream takes the token in the query
+	resp, err := http.Get(ts.URL + "/api/covers/" + hash + "?token=" + testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 with the token in the query, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/covers/"+hash, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("unexpected response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if status := ts.do(t, http.MethodGet, "/api/covers/00000000000000000000000000000000", nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing cover, got %d", status)
+	}
+	if status := ts.do(t, http.MethodGet, "/api/covers/..%2f..%2fetc%2fpasswd", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid hash, got %d", status)
+	}
+}
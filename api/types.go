@@ -0,0 +1,102 @@
+package api
+
+import "github.com/EricZhang456/mumble-music-bot/media"
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type trackResponse struct {
+	ID          uint     `json:"id"`
+	Title       string   `json:"title"`
+	Artists     *string  `json:"artists,omitempty"`
+	Album       *string  `json:"album,omitempty"`
+	AlbumArtist *string  `json:"album_artist,omitempty"`
+	Composer    *string  `json:"composer,omitempty"`
+	Genre       *string  `json:"genre,omitempty"`
+	Year        *int     `json:"year,omitempty"`
+	TrackNum    *int     `json:"track_num,omitempty"`
+	DiscNum     *int     `json:"disc_num,omitempty"`
+	DurationMs  *int64   `json:"duration_ms,omitempty"`
+	TrackGain   *float64 `json:"track_gain,omitempty"`
+	AlbumGain   *float64 `json:"album_gain,omitempty"`
+	CoverArt    *string  `json:"cover_art,omitempty"`
+}
+
+type trackListResponse struct {
+	Tracks []trackResponse `json:"tracks"`
+	Total  int64           `json:"total"`
+}
+
+type queueResponse struct {
+	Tracks       []trackResponse `json:"tracks"`
+	CurrentIndex int             `json:"current_index"`
+}
+
+type statusResponse struct {
+	Playing     bool           `json:"playing"`
+	Paused      bool           `json:"paused"`
+	Track       *trackResponse `json:"track,omitempty"`
+	PositionMs  *int64         `json:"position_ms,omitempty"`
+	Mode        string         `json:"mode"`
+	Volume      int            `json:"volume"`
+	QueueLength int            `json:"queue_length"`
+}
+
+type modeRequest struct {
+	Mode string `json:"mode"`
+}
+
+type modeResponse struct {
+	Mode string `json:"mode"`
+}
+
+// either a single track or several, they're added in order
+type addRequest struct {
+	TrackID  uint   `json:"track_id"`
+	TrackIDs []uint `json:"track_ids"`
+}
+
+type moveRequest struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+type seekRequest struct {
+	PositionMs int64 `json:"position_ms"`
+}
+
+type messageResponse struct {
+	Message string `json:"message"`
+}
+
+func trackFromAudioData(data *media.AudioData) trackResponse {
+	track := trackResponse{
+		ID:          data.ID,
+		Title:       data.Title,
+		Artists:     data.Artists,
+		Album:       data.Album,
+		AlbumArtist: data.AlbumArtist,
+		Composer:    data.Composer,
+		Genre:       data.Genre,
+		Year:        data.Year,
+		TrackNum:    data.TrackNum,
+		DiscNum:     data.DiscNum,
+		TrackGain:   data.TrackGain,
+		AlbumGain:   data.AlbumGain,
+		CoverArt:    data.CoverArt,
+	}
+	if data.Duration != nil {
+		ms := data.Duration.Milliseconds()
+		track.DurationMs = &ms
+	}
+	return track
+}
+
+func tracksFromAudioData(data []media.AudioData) []trackResponse {
+	tracks := make([]trackResponse, 0, len(data))
+	for index := range data {
+		tracks = append(tracks, trackFromAudioData(&data[index]))
+	}
+	return tracks
+}
@@ -0,0 +1,266 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/EricZhang456/mumble-music-bot/media"
+)
+
+// the page number at args[index], 1 if it isn't there
+func parsePageArg(args []string, index int) (int, bool) {
+	if len(args) <= index {
+		return 1, true
+	}
+	pageNum, err := strconv.Atoi(args[index])
+	return pageNum, err == nil
+}
+
+func (com *MusicPlayerCommandHandler) numPages(total int64) int {
+	return int(math.Ceil(float64(total) / float64(com.pageSize)))
+}
+
+// next is the command that shows the page after this one, without the prefix or page number
+func (com *MusicPlayerCommandHandler) formatPage(title string, lines []string, pageNum, numPages int, next string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("<br><b>%s, showing page %d of %d</b>:<br>", title, pageNum, numPages))
+	sb.WriteString(strings.Join(lines, "<br>"))
+	if pageNum != numPages {
+		sb.WriteString(fmt.Sprintf("<br><br>Type <b>%s%s %d</b> to see the next page.", com.commandPrefix, next, pageNum+1))
+	}
+	return sb.String()
+}
+
+func quoteArg(arg string) string {
+	return "&quot;" + html.EscapeString(arg) + "&quot;"
+}
+
+func formatAlbumSummary(album media.AlbumSummary) string {
+	var sb strings.Builder
+	sb.WriteString("<b>" + html.EscapeString(album.Album) + "</b>")
+	if album.Artist != nil {
+		sb.WriteString(" by " + html.EscapeString(*album.Artist))
+	}
+	if album.Year != nil {
+		sb.WriteString(fmt.Sprintf(" (%d)", *album.Year))
+	}
+	sb.WriteString(fmt.Sprintf(" <i>%d tracks</i>", album.TrackCount))
+	return sb.String()
+}
+
+// the album the query names, or the reply to send when there isn't exactly one
+func (com *MusicPlayerCommandHandler) findAlbum(query string) (*media.AlbumSummary, string) {
+	albums, err := media.FindClosestAlbums(com.db, query)
+	if err != nil {
+		return nil, "Database error while fetching albums."
+	}
+	switch len(albums) {
+	case 0:
+		return nil, "No matching album found."
+	case 1:
+		return &albums[0], ""
+	}
+	lines := make([]string, 0, len(albums))
+	for _, a := range albums {
+		lines = append(lines, formatAlbumSummary(a))
+	}
+	return nil, fmt.Sprintf("<br>More than one album is called <b>%s</b>, add the artist to pick one (<i>album by artist</i>):<br>%s",
+		html.EscapeString(albums[0].Album), strings.Join(lines, "<br>"))
+}
+
+func (com *MusicPlayerCommandHandler) listAlbums(args []string) string {
+	pageNum, ok := parsePageArg(args, 0)
+	if !ok {
+		return "Not a valid page number."
+	}
+	if pageNum <= 0 {
+		return "Page number out of range."
+	}
+	albums, total, err := media.ListAlbums(com.db, com.pageSize, (pageNum-1)*com.pageSize)
+	if err != nil {
+		return "Database error while fetching albums."
+	}
+	if total == 0 {
+		return "No albums available."
+	}
+	numPages := com.numPages(total)
+	if pageNum > numPages {
+		return "Page number out of range."
+	}
+	lines := make([]string, 0, len(albums))
+	for _, a := range albums {
+		lines = append(lines, formatAlbumSummary(a))
+	}
+	return com.formatPage("Albums", lines, pageNum, numPages, "albums")
+}
+
+func (com *MusicPlayerCommandHandler) listArtists(args []string) string {
+	pageNum, ok := parsePageArg(args, 0)
+	if !ok {
+		return "Not a valid page number."
+	}
+	if pageNum <= 0 {
+		return "Page number out of range."
+	}
+	artists, total, err := media.ListArtists(com.db, com.pageSize, (pageNum-1)*com.pageSize)
+	if err != nil {
+		return "Database error while fetching artists."
+	}
+	if total == 0 {
+		return "No artists available."
+	}
+	numPages := com.numPages(total)
+	if pageNum > numPages {
+		return "Page number out of range."
+	}
+	lines := make([]string, 0, len(artists))
+	for _, a := range artists {
+		lines = append(lines, fmt.Sprintf("<b>%s</b> <i>%d albums, %d tracks</i>", html.EscapeString(a.Artist), a.AlbumCount, a.TrackCount))
+	}
+	return com.formatPage("Artists", lines, pageNum, numPages, "artists")
+}
+
+func (com *MusicPlayerCommandHandler) listGenres(args []string) string {
+	pageNum, ok := parsePageArg(args, 0)
+	if !ok {
+		return "Not a valid page number."
+	}
+	if pageNum <= 0 {
+		return "Page number out of range."
+	}
+	genres, total, err := media.ListGenres(com.db, com.pageSize, (pageNum-1)*com.pageSize)
+	if err != nil {
+		return "Database error while fetching genres."
+	}
+	if total == 0 {
+		return "No genres available."
+	}
+	numPages := com.numPages(total)
+	if pageNum > numPages {
+		return "Page number out of range."
+	}
+	lines := make([]string, 0, len(genres))
+	for _, g := range genres {
+		lines = append(lines, fmt.Sprintf("<b>%s</b> <i>%d tracks</i>", html.EscapeString(g.Genre), g.TrackCount))
+	}
+	return com.formatPage("Genres", lines, pageNum, numPages, "genres")
+}
+
+func (com *MusicPlayerCommandHandler) showArtist(args []string) string {
+	pageNum, ok := parsePageArg(args, 1)
+	if !ok {
+		return "Not a valid page number."
+	}
+	if pageNum <= 0 {
+		return "Page number out of range."
+	}
+	artist, err := media.FindClosestArtist(com.db, args[0])
+	if err != nil {
+		return "Database error while fetching artists."
+	}
+	if artist == "" {
+		return "No matching artist found."
+	}
+	albums, total, err := media.ListAlbumsByArtist(com.db, artist, com.pageSize, (pageNum-1)*com.pageSize)
+	if err != nil {
+		return "Database error while fetching albums."
+	}
+	if total == 0 {
+		return "<b>" + html.EscapeString(artist) + "</b> has no albums."
+	}
+	numPages := com.numPages(total)
+	if pageNum > numPages {
+		return "Page number out of range."
+	}
+	lines := make([]string, 0, len(albums))
+	for _, a := range albums {
+		lines = append(lines, formatAlbumSummary(a))
+	}
+	return com.formatPage("Albums by "+html.EscapeString(artist), lines, pageNum, numPages, "artist "+quoteArg(artist))
+}
+
+func (com *MusicPlayerCommandHandler) showAlbum(args []string) string {
+	pageNum, ok := parsePageArg(args, 1)
+	if !ok {
+		return "Not a valid page number."
+	}
+	if pageNum <= 0 {
+		return "Page number out of range."
+	}
+	album, reply := com.findAlbum(args[0])
+	if album == nil {
+		return reply
+	}
+	tracks, err := media.FindAlbumTracks(com.db, album.Album, album.Artist)
+	if err != nil {
+		return "Database error while fetching album tracks."
+	}
+	if len(tracks) == 0 {
+		return "No tracks found for album " + html.EscapeString(album.FullName())
+	}
+	numPages := com.numPages(int64(len(tracks)))
+	if pageNum > numPages {
+		return "Page number out of range."
+	}
+	page := tracks[(pageNum-1)*com.pageSize : min(pageNum*com.pageSize, len(tracks))]
+	lines := make([]string, 0, len(page))
+	for _, t := range page {
+		lines = append(lines, fmt.Sprintf("<b>%d:</b> %s", t.ID, t.ToString()))
+	}
+	return com.formatPage("Album "+html.EscapeString(album.FullName()), lines, pageNum, numPages, "album "+quoteArg(album.FullName()))
+}
+
+func (com *MusicPlayerCommandHandler) showGenre(args []string) string {
+	pageNum, ok := parsePageArg(args, 1)
+	if !ok {
+		return "Not a valid page number."
+	}
+	if pageNum <= 0 {
+		return "Page number out of range."
+	}
+	genre, err := media.FindClosestGenre(com.db, args[0])
+	if err != nil {
+		return "Database error while fetching genres."
+	}
+	if genre == "" {
+		return "No matching genre found."
+	}
+	tracks, total, err := media.FindGenreTracks(com.db, genre, com.pageSize, (pageNum-1)*com.pageSize)
+	if err != nil {
+		return "Database error while fetching genre tracks."
+	}
+	if total == 0 {
+		return "No tracks found for genre " + html.EscapeString(genre)
+	}
+	numPages := com.numPages(total)
+	if pageNum > numPages {
+		return "Page number out of range."
+	}
+	lines := make([]string, 0, len(tracks))
+	for _, t := range tracks {
+		lines = append(lines, fmt.Sprintf("<b>%d:</b> %s", t.ID, t.ToString()))
+	}
+	return com.formatPage("Genre "+html.EscapeString(genre), lines, pageNum, numPages, "genre "+quoteArg(genre))
+}
+
+func (com *MusicPlayerCommandHandler) addArtist(args []string) string {
+	artist, err := media.FindClosestArtist(com.db, args[0])
+	if err != nil {
+		return "Database error while fetching artists."
+	}
+	if artist == "" {
+		return "No matching artist found."
+	}
+	tracks, err := media.FindArtistTracks(com.db, artist)
+	if err != nil {
+		return "Database error while fetching artist tracks."
+	}
+	if len(tracks) == 0 {
+		return "No tracks found for artist " + html.EscapeString(artist)
+	}
+	com.mp.AddAllToPlaylist(tracks)
+	return fmt.Sprintf("Adding every track by <b>%s</b> to playlist. (%d tracks)", html.EscapeString(artist), len(tracks))
+}
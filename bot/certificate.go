@@ -0,0 +1,89 @@
+package bot
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// loads the pair, or makes a self-signed one and writes it out if neither file exists yet
+func LoadOrCreateCertificate(certFile, keyFile, commonName string) (tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		if err := createCertificate(certFile, keyFile, commonName); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// same kind of certificate the Mumble client generates for new users
+func createCertificate(certFile, keyFile, commonName string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(20, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	certOut := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyOut := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, keyOut, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, certOut, 0644)
+}
+
+// accepts SHA-1 (what the Mumble client shows) or SHA-256 hex digests, colons and case don't matter
+func verifyFingerprint(fingerprint string) func([][]byte, [][]*x509.Certificate) error {
+	want := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("Server did not present a certificate.")
+		}
+		var got string
+		switch len(want) {
+		case sha1.Size * 2:
+			sum := sha1.Sum(rawCerts[0])
+			got = hex.EncodeToString(sum[:])
+		case sha256.Size * 2:
+			sum := sha256.Sum256(rawCerts[0])
+			got = hex.EncodeToString(sum[:])
+		default:
+			return fmt.Errorf("Invalid server fingerprint: %s", fingerprint)
+		}
+		if got != want {
+			return fmt.Errorf("Server certificate fingerprint %s does not match pinned fingerprint.", got)
+		}
+		return nil
+	}
+}
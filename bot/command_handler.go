@@ -1,12 +1,19 @@
 package bot
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"html"
 	"log"
 	"math"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/EricZhang456/mumble-music-bot/media"
 	"github.com/EricZhang456/mumble-music-bot/utils"
@@ -14,57 +21,224 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	volumeSettingKey        = "volume"
+	normalizeSettingKey     = "normalize"
+	voteSkipSettingKey      = "voteskip"
+	voteSkipRatioSettingKey = "voteskip_ratio"
+)
+
+const defaultVoteSkipRatio = 0.5
+
+type ReplyTarget int
+
+const (
+	ReplyChannel ReplyTarget = iota
+	ReplySender
+)
+
+type CommandReply struct {
+	Message string
+	Target  ReplyTarget
+}
+
 type CommandHandler interface {
-	HandleCommand(commandRaw string) *string
+	HandleCommand(sender *CommandSender, commandRaw string) *CommandReply
 }
 
+const replyTargetSettingPrefix = "reply_target:"
+
 type MusicPlayerCommandHandler struct {
-	mp            *MusicPlayer
-	db            *gorm.DB
-	pageSize      int
-	commandPrefix string
-	allTrackPages [][]media.AudioData
-	allTracks     []media.AudioData
-	allAlbums     []string
+	mp              *MusicPlayer
+	db              *gorm.DB
+	pageSize        int
+	commandPrefix   string
+	scanner         *media.AudioScanner
+	musicPath       string
+	exportPath      string
+	defaultRole     Role
+	adminCertHashes []string
+	voteSkip        bool
+	voteSkipRatio   float64
+	replyTargets    map[string]ReplyTarget
+	registry        *CommandRegistry
+	mu              sync.Mutex
 }
 
 func CreateCommandHandler(commandPrefix string, mp *MusicPlayer, db *gorm.DB) *MusicPlayerCommandHandler {
-	commandHandler := &MusicPlayerCommandHandler{mp: mp, db: db, commandPrefix: commandPrefix}
-	if err := commandHandler.populatePages(5); err != nil {
-		log.Fatal("Cannot populate pages for command handler.")
+	commandHandler := &MusicPlayerCommandHandler{mp: mp, db: db, commandPrefix: commandPrefix, pageSize: 5, defaultRole: RoleDJ, voteSkipRatio: defaultVoteSkipRatio}
+	commandHandler.registry = CreateCommandRegistry()
+	commandHandler.registerBuiltinCommands()
+	if err := commandHandler.restoreVolume(); err != nil {
+		log.Println("Cannot restore volume from DB: ", err)
+	}
+	if err := commandHandler.restoreNormalizeMode(); err != nil {
+		log.Println("Cannot restore normalization mode from DB: ", err)
 	}
-	if err := commandHandler.populateAlbums(); err != nil {
-		log.Fatal("Cannot fetch albums from DB.")
+	if err := commandHandler.restoreVoteSkip(); err != nil {
+		log.Println("Cannot restore vote skip settings from DB: ", err)
+	}
+	if err := commandHandler.restoreReplyTargets(); err != nil {
+		log.Println("Cannot restore reply targets from DB: ", err)
 	}
 	return commandHandler
 }
 
-func (com *MusicPlayerCommandHandler) populatePages(pageSize int) error {
-	if err := com.db.Find(&com.allTracks).Error; err != nil {
+func (com *MusicPlayerCommandHandler) findTrack(idStr string) (*media.AudioData, error) {
+	trackId, err := strconv.Atoi(idStr)
+	if err != nil || trackId <= 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var track media.AudioData
+	if err := com.db.First(&track, trackId).Error; err != nil {
+		return nil, err
+	}
+	return &track, nil
+}
+
+func (com *MusicPlayerCommandHandler) restoreVolume() error {
+	value, ok, err := loadSetting(com.db, volumeSettingKey)
+	if err != nil || !ok {
 		return err
 	}
+	volume, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	com.mp.SetVolume(volume)
+	return nil
+}
 
-	numPages := int(math.Ceil(float64(len(com.allTracks)) / float64(pageSize)))
-	com.pageSize = pageSize
-	com.allTrackPages = make([][]media.AudioData, 0, numPages)
+func (com *MusicPlayerCommandHandler) restoreNormalizeMode() error {
+	value, ok, err := loadSetting(com.db, normalizeSettingKey)
+	if err != nil || !ok {
+		return err
+	}
+	mode, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	com.mp.SetNormalizeMode(NormalizeMode(mode))
+	return nil
+}
 
-	for i := 0; i < len(com.allTracks); i += pageSize {
-		end := min(i+pageSize, len(com.allTracks))
-		com.allTrackPages = append(com.allTrackPages, com.allTracks[i:end])
+func (com *MusicPlayerCommandHandler) restoreVoteSkip() error {
+	value, ok, err := loadSetting(com.db, voteSkipSettingKey)
+	if err != nil {
+		return err
+	}
+	if ok {
+		com.voteSkip, _ = strconv.ParseBool(value)
 	}
+	value, ok, err = loadSetting(com.db, voteSkipRatioSettingKey)
+	if err != nil || !ok {
+		return err
+	}
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	com.voteSkipRatio = ratio
 	return nil
 }
 
-func (com *MusicPlayerCommandHandler) populateAlbums() error {
-	var albums []string
-	if err := com.db.Model(&media.AudioData{}).Distinct("album").Where("album IS NOT NULL").Pluck("album", &albums).Error; err != nil {
+func (com *MusicPlayerCommandHandler) restoreReplyTargets() error {
+	var settings []Setting
+	if err := com.db.Where("substr(key, 1, length(?)) = ?", replyTargetSettingPrefix, replyTargetSettingPrefix).Find(&settings).Error; err != nil {
 		return err
 	}
-	com.allAlbums = albums
+	com.replyTargets = make(map[string]ReplyTarget, len(settings))
+	for _, setting := range settings {
+		target, err := strconv.Atoi(setting.Value)
+		if err != nil {
+			continue
+		}
+		com.replyTargets[strings.TrimPrefix(setting.Key, replyTargetSettingPrefix)] = ReplyTarget(target)
+	}
 	return nil
 }
 
-func (com *MusicPlayerCommandHandler) HandleCommand(commandRaw string) *string {
+// private commands get private replies, otherwise it's configured per command and lookups go to the sender by default
+func (com *MusicPlayerCommandHandler) replyTarget(top, cmd *Command, ctx *CommandContext) ReplyTarget {
+	if ctx.Sender != nil && ctx.Sender.Private {
+		return ReplySender
+	}
+	if target, ok := com.replyTargets[top.Name]; ok {
+		return target
+	}
+	if cmd.SenderReply && cmd.requiredRole(ctx) == RoleListener {
+		return ReplySender
+	}
+	return ReplyChannel
+}
+
+// lets other packages add their own commands, names and aliases must not be taken yet
+func (com *MusicPlayerCommandHandler) RegisterCommand(cmd *Command) error {
+	return com.registry.Register(cmd)
+}
+
+func (com *MusicPlayerCommandHandler) Player() *MusicPlayer {
+	return com.mp
+}
+
+func (com *MusicPlayerCommandHandler) DB() *gorm.DB {
+	return com.db
+}
+
+func (com *MusicPlayerCommandHandler) SetLibraryScanner(scanner *media.AudioScanner, musicPath string) {
+	com.mu.Lock()
+	defer com.mu.Unlock()
+	com.scanner = scanner
+	com.musicPath = musicPath
+}
+
+// exported playlists are written here, it's usually the music path so they get picked up by the scanner
+func (com *MusicPlayerCommandHandler) SetPlaylistExportPath(exportPath string) {
+	com.mu.Lock()
+	defer com.mu.Unlock()
+	com.exportPath = exportPath
+}
+
+// the role everyone has unless granted something else
+func (com *MusicPlayerCommandHandler) SetDefaultRole(role Role) {
+	com.mu.Lock()
+	defer com.mu.Unlock()
+	com.defaultRole = role
+}
+
+// users with these certificate hashes are always admins, so there's someone to grant roles
+func (com *MusicPlayerCommandHandler) SetAdminCertHashes(hashes []string) {
+	com.mu.Lock()
+	defer com.mu.Unlock()
+	com.adminCertHashes = make([]string, 0, len(hashes))
+	for _, h := range hashes {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			com.adminCertHashes = append(com.adminCertHashes, h)
+		}
+	}
+}
+
+// walks down into subcommands, returns the top level command, the one that runs, its full name and its args
+func (com *MusicPlayerCommandHandler) resolveCommand(verb string, args []string) (*Command, *Command, string, []string) {
+	top := com.registry.Lookup(verb)
+	if top == nil {
+		return nil, nil, "", nil
+	}
+	cmd := top
+	fullName := top.Name
+	for len(args) > 0 {
+		sub := cmd.findSubcommand(args[0])
+		if sub == nil {
+			break
+		}
+		cmd = sub
+		fullName += " " + sub.Name
+		args = args[1:]
+	}
+	return top, cmd, fullName, args
+}
+
+func (com *MusicPlayerCommandHandler) HandleCommand(sender *CommandSender, commandRaw string) *CommandReply {
 	commandRawUnescape := html.UnescapeString(commandRaw)
 	commandTrimmed := strings.TrimSpace(commandRawUnescape)
 	if !strings.HasPrefix(commandTrimmed, com.commandPrefix) {
@@ -75,78 +249,321 @@ func (com *MusicPlayerCommandHandler) HandleCommand(commandRaw string) *string {
 	if err != nil {
 		return nil
 	}
-	verb := strings.ToLower(commandParts[0])
-	args := commandParts[1:]
-	// i hate this
-	switch verb {
-	case "help":
-		result := com.replyHelp()
-		return &result
-	case "tracks":
-		result := com.getTracks(args)
-		return &result
-	case "add":
-		result := com.addTrack(args)
-		return &result
-	case "addalbum":
-		result := com.addAlbum(args)
-		return &result
-	case "mode":
-		result := com.setOrGetMode(args)
-		return &result
-	case "remove":
-		result := com.removeFromPlaylist(args)
-		return &result
-	case "skip":
-		result := com.skipTrack()
-		return &result
-	case "playlist":
-		result := com.replyPlaylist()
-		return &result
-	case "nowplaying":
-		result := com.replyNowPlaying()
-		return &result
-	case "start":
-		result := com.startPlaylist()
-		return &result
-	case "stop":
-		result := com.stopPlaylist()
-		return &result
-	case "clear":
-		result := com.clearPlaylist()
-		return &result
-	case "pause":
-		result := com.pauseToggle()
-		return &result
+	if len(commandParts) == 0 {
+		return nil
+	}
+	top, cmd, fullName, args := com.resolveCommand(commandParts[0], commandParts[1:])
+	if cmd == nil {
+		return nil
 	}
-	return nil
+	com.mu.Lock()
+	defer com.mu.Unlock()
+	ctx := &CommandContext{Handler: com, Sender: sender, Args: args}
+	event := CommandIssuedEvent{Command: fullName, Args: args, Result: CommandOK}
+	if sender != nil {
+		event.Sender = sender.Name
+	}
+	if com.resolveRole(sender) < cmd.requiredRole(ctx) {
+		event.Result = CommandDenied
+		com.commandIssued(event)
+		return &CommandReply{Message: "You don't have permission to do that.", Target: ReplySender}
+	}
+	if !cmd.validateArgs(args) {
+		event.Result = CommandUsage
+		com.commandIssued(event)
+		if len(cmd.Subcommands) > 0 && len(args) > 0 {
+			return &CommandReply{Message: fmt.Sprintf("Unknown %s command: %s", fullName, html.EscapeString(args[0])), Target: ReplySender}
+		}
+		return &CommandReply{Message: "<b>Usage:</b> " + cmd.usage(com.commandPrefix, fullName), Target: ReplySender}
+	}
+	ctx.Args = cmd.collectArgs(args)
+	com.commandIssued(event)
+	return &CommandReply{Message: cmd.Run(ctx), Target: com.replyTarget(top, cmd, ctx)}
+}
+
+func (com *MusicPlayerCommandHandler) commandIssued(event CommandIssuedEvent) {
+	com.mp.bot.events.Publish(event)
+	com.mp.bot.recordStats(func(stats StatsRecorder) {
+		stats.CommandIssued(event.Command, event.Result)
+	})
+}
+
+// anyone can look, changing it needs the role
+func roleToChange(role Role) func(ctx *CommandContext) Role {
+	return func(ctx *CommandContext) Role {
+		if len(ctx.Args) == 0 {
+			return RoleListener
+		}
+		return role
+	}
+}
+
+func (com *MusicPlayerCommandHandler) registerBuiltinCommands() {
+	commands := []*Command{
+		{
+			Name: "help", Args: []CommandArg{{Name: "command", Optional: true, Rest: true}}, Role: RoleListener, SenderReply: true,
+			Help: "Show available commands, or everything about one command.",
+			Run:  func(ctx *CommandContext) string { return com.replyHelp(ctx.Args) },
+		},
+		{
+			Name: "tracks", Args: []CommandArg{{Name: "page number", Optional: true}}, Role: RoleListener, SenderReply: true,
+			Help: "Show available tracks. Invoke with no arguments to show the first page.",
+			Run:  func(ctx *CommandContext) string { return com.getTracks(ctx.Args) },
+		},
+		{
+			Name: "search", Args: []CommandArg{{Name: "query"}, {Name: "page number", Optional: true}}, Role: RoleListener, SenderReply: true,
+			Help: "Search tracks by title, artist or album. Put the query in quotes if it has more than one word.",
+			Run:  func(ctx *CommandContext) string { return com.searchTracks(ctx.Args) },
+		},
+		{
+			Name: "info", Args: []CommandArg{{Name: "track id"}}, Role: RoleListener, SenderReply: true,
+			Help: "Show everything known about a track.",
+			Run:  func(ctx *CommandContext) string { return com.replyTrackInfo(ctx.Args) },
+		},
+		{
+			Name: "albums", Args: []CommandArg{{Name: "page number", Optional: true}}, Role: RoleListener, SenderReply: true,
+			Help: "Show available albums.",
+			Run:  func(ctx *CommandContext) string { return com.listAlbums(ctx.Args) },
+		},
+		{
+			Name: "album", Args: []CommandArg{{Name: "album name"}, {Name: "page number", Optional: true}}, Role: RoleListener, SenderReply: true,
+			Help: "Show the tracks on an album. Put the name in quotes if it has more than one word.",
+			Run:  func(ctx *CommandContext) string { return com.showAlbum(ctx.Args) },
+		},
+		{
+			Name: "artists", Args: []CommandArg{{Name: "page number", Optional: true}}, Role: RoleListener, SenderReply: true,
+			Help: "Show available artists.",
+			Run:  func(ctx *CommandContext) string { return com.listArtists(ctx.Args) },
+		},
+		{
+			Name: "artist", Args: []CommandArg{{Name: "artist name"}, {Name: "page number", Optional: true}}, Role: RoleListener, SenderReply: true,
+			Help: "Show the albums by an artist. Put the name in quotes if it has more than one word.",
+			Run:  func(ctx *CommandContext) string { return com.showArtist(ctx.Args) },
+		},
+		{
+			Name: "genres", Args: []CommandArg{{Name: "page number", Optional: true}}, Role: RoleListener, SenderReply: true,
+			Help: "Show available genres.",
+			Run:  func(ctx *CommandContext) string { return com.listGenres(ctx.Args) },
+		},
+		{
+			Name: "genre", Args: []CommandArg{{Name: "genre"}, {Name: "page number", Optional: true}}, Role: RoleListener, SenderReply: true,
+			Help: "Show the tracks in a genre. Put the name in quotes if it has more than one word.",
+			Run:  func(ctx *CommandContext) string { return com.showGenre(ctx.Args) },
+		},
+		{
+			Name: "add", Args: []CommandArg{{Name: "track id"}}, Role: RoleDJ,
+			Help: "Add a track to playlist by its track ID.",
+			Run:  func(ctx *CommandContext) string { return com.addTrack(ctx.Args) },
+		},
+		{
+			Name: "addalbum", Args: []CommandArg{{Name: "album name", Rest: true}}, Role: RoleDJ,
+			Help: "Add an entire album to playlist.",
+			Run:  func(ctx *CommandContext) string { return com.addAlbum(ctx.Args) },
+		},
+		{
+			Name: "addartist", Args: []CommandArg{{Name: "artist name", Rest: true}}, Role: RoleDJ,
+			Help: "Add every track by an artist to playlist.",
+			Run:  func(ctx *CommandContext) string { return com.addArtist(ctx.Args) },
+		},
+		{
+			Name: "mode", Args: []CommandArg{{Name: "playback mode", Optional: true}}, Role: RoleDJ, Permission: roleToChange(RoleDJ),
+			Help: "Set playback mode. Invoke with no arguments to see current plaback mode. " +
+				"Available values are: &quot;single&quot;, &quot;shuffle&quot;, &quot;repeat&quot;, &quot;shufflerepeat&quot;.",
+			Run: func(ctx *CommandContext) string { return com.setOrGetMode(ctx.Args) },
+		},
+		{
+			Name: "remove", Args: []CommandArg{{Name: "queue id"}}, Role: RoleDJ,
+			Help: "Remove a track from playlist by the ID it has in the playlist.",
+			Run:  func(ctx *CommandContext) string { return com.removeFromPlaylist(ctx.Args) },
+		},
+		{
+			Name: "skip", Aliases: []string{"next"}, Role: RoleDJ,
+			Permission: func(ctx *CommandContext) Role {
+				if com.voteSkip {
+					return RoleListener
+				}
+				return RoleDJ
+			},
+			Help: "Skip the current track, or vote to skip it if vote skipping is on.",
+			Run:  func(ctx *CommandContext) string { return com.skipTrack(ctx.Sender) },
+		},
+		{
+			Name: "voteskip", Args: []CommandArg{{Name: "on|off|percent", Optional: true}}, Role: RoleAdmin, Permission: roleToChange(RoleAdmin),
+			Help: "Turn vote skipping on or off, or set the percentage of listeners needed to skip. Invoke with no arguments to see the current setting.",
+			Run:  func(ctx *CommandContext) string { return com.setOrGetVoteSkip(ctx.Args) },
+		},
+		{
+			Name: "nowplaying", Aliases: []string{"np"}, Role: RoleListener,
+			Help: "Show what's playing right now.",
+			Run:  func(ctx *CommandContext) string { return com.replyNowPlaying() },
+		},
+		{
+			Name: "playlist", Aliases: []string{"queue"}, Role: RoleListener, SenderReply: true,
+			Help: "Show the current playlist.",
+			Run:  func(ctx *CommandContext) string { return com.replyPlaylist() },
+			Subcommands: []*Command{
+				{
+					Name: "save", Args: []CommandArg{{Name: "name", Rest: true}}, Role: RoleDJ,
+					Help: "Save the current playlist under a name, replacing any saved playlist with that name.",
+					Run:  func(ctx *CommandContext) string { return com.savePlaylist(ctx.Args[0]) },
+				},
+				{
+					Name: "load", Args: []CommandArg{{Name: "name", Rest: true}}, Role: RoleDJ,
+					Help: "Add a saved playlist to the current playlist.",
+					Run:  func(ctx *CommandContext) string { return com.loadPlaylist(ctx.Args[0]) },
+				},
+				{
+					Name: "list", Role: RoleListener, SenderReply: true,
+					Help: "Show all saved playlists.",
+					Run:  func(ctx *CommandContext) string { return com.listSavedPlaylists() },
+				},
+				{
+					Name: "show", Args: []CommandArg{{Name: "name", Rest: true}}, Role: RoleListener, SenderReply: true,
+					Help: "Show the tracks in a saved playlist.",
+					Run:  func(ctx *CommandContext) string { return com.showSavedPlaylist(ctx.Args[0]) },
+				},
+				{
+					Name: "delete", Args: []CommandArg{{Name: "name", Rest: true}}, Role: RoleAdmin,
+					Help: "Delete a saved playlist.",
+					Run:  func(ctx *CommandContext) string { return com.deleteSavedPlaylist(ctx.Args[0]) },
+				},
+			},
+		},
+		{
+			Name: "loadfile", Args: []CommandArg{{Name: "name", Optional: true, Rest: true}}, Role: RoleDJ,
+			Help: "Add a playlist file from the music library to the playlist. Invoke with no arguments to see available playlist files.",
+			Run:  func(ctx *CommandContext) string { return com.loadPlaylistFile(ctx.Args) },
+		},
+		{
+			Name: "exportqueue", Args: []CommandArg{{Name: "format"}, {Name: "name", Optional: true}}, Role: RoleDJ,
+			Help: "Write the current playlist to a playlist file. Available formats are: &quot;m3u8&quot;, &quot;pls&quot;, &quot;xspf&quot;.",
+			Run:  func(ctx *CommandContext) string { return com.exportQueue(ctx.Args) },
+		},
+		{
+			Name: "start", Aliases: []string{"play"}, Role: RoleDJ,
+			Help: "Start playback.",
+			Run:  func(ctx *CommandContext) string { return com.startPlaylist() },
+		},
+		{
+			Name: "stop", Role: RoleDJ,
+			Help: "Stop playback and rewind to the first track in playlist.",
+			Run:  func(ctx *CommandContext) string { return com.stopPlaylist() },
+		},
+		{
+			Name: "pause", Role: RoleDJ,
+			Help: "Pause/Unpause playback.",
+			Run:  func(ctx *CommandContext) string { return com.pauseToggle() },
+		},
+		{
+			Name: "seek", Args: []CommandArg{{Name: "mm:ss"}}, Role: RoleDJ,
+			Help: "Jump to a position in the current track.",
+			Run:  func(ctx *CommandContext) string { return com.seekTo(ctx.Args) },
+		},
+		{
+			Name: "forward", Args: []CommandArg{{Name: "seconds"}}, Role: RoleDJ,
+			Help: "Skip ahead in the current track.",
+			Run:  func(ctx *CommandContext) string { return com.seekBy(ctx.Args, 1) },
+		},
+		{
+			Name: "rewind", Args: []CommandArg{{Name: "seconds"}}, Role: RoleDJ,
+			Help: "Go back in the current track.",
+			Run:  func(ctx *CommandContext) string { return com.seekBy(ctx.Args, -1) },
+		},
+		{
+			Name: "volume", Aliases: []string{"vol"}, Args: []CommandArg{{Name: "0-100", Optional: true}}, Role: RoleDJ, Permission: roleToChange(RoleDJ),
+			Help: "Set playback volume. Invoke with no arguments to see the current volume.",
+			Run:  func(ctx *CommandContext) string { return com.setOrGetVolume(ctx.Args) },
+		},
+		{
+			Name: "normalize", Args: []CommandArg{{Name: "mode", Optional: true}}, Role: RoleDJ, Permission: roleToChange(RoleDJ),
+			Help: "Set loudness normalization using ReplayGain. Invoke with no arguments to see the current mode. " +
+				"Available values are: &quot;off&quot;, &quot;track&quot;, &quot;album&quot;.",
+			Run: func(ctx *CommandContext) string { return com.setOrGetNormalizeMode(ctx.Args) },
+		},
+		{
+			Name: "clear", Role: RoleAdmin,
+			Help: "Stop playback and clear playlist.",
+			Run:  func(ctx *CommandContext) string { return com.clearPlaylist() },
+		},
+		{
+			Name: "rescan", Role: RoleAdmin,
+			Help: "Rescan the music library in the background.",
+			Run:  func(ctx *CommandContext) string { return com.rescanLibrary() },
+		},
+		{
+			Name: "grant", Args: []CommandArg{{Name: "user"}, {Name: "role"}}, Role: RoleAdmin,
+			Help: "Give a user a role. Available values are: &quot;listener&quot;, &quot;dj&quot;, &quot;admin&quot;.",
+			Run:  func(ctx *CommandContext) string { return com.grantRole(ctx.Args) },
+		},
+		{
+			Name: "revoke", Args: []CommandArg{{Name: "user"}}, Role: RoleAdmin,
+			Help: "Take a user's role away.",
+			Run:  func(ctx *CommandContext) string { return com.revokeRole(ctx.Args) },
+		},
+		{
+			Name: "roles", Role: RoleAdmin,
+			Help: "Show users that have been given a role.",
+			Run:  func(ctx *CommandContext) string { return com.replyRoles() },
+		},
+		{
+			Name: "replyto", Args: []CommandArg{{Name: "command"}, {Name: "channel|sender", Optional: true}}, Role: RoleAdmin,
+			Help: "Choose whether replies to a command go to the channel or only to whoever sent it. Invoke with just the command to see where its replies go.",
+			Run:  func(ctx *CommandContext) string { return com.setOrGetReplyTarget(ctx.Args) },
+		},
+	}
+	for _, cmd := range commands {
+		if err := com.registry.Register(cmd); err != nil {
+			log.Fatal("Cannot register built-in command: ", err)
+		}
+	}
+}
+
+func (com *MusicPlayerCommandHandler) replyHelp(args []string) string {
+	if len(args) > 0 {
+		return com.replyCommandHelp(strings.Fields(args[0]))
+	}
+	var sb strings.Builder
+	sb.WriteString("<br><b>Available Commands:</b>")
+	for _, cmd := range com.registry.Commands() {
+		sb.WriteString(fmt.Sprintf("<br><b>%s:</b> %s", cmd.usage(com.commandPrefix, cmd.Name), cmd.Help))
+		for _, sub := range cmd.Subcommands {
+			sb.WriteString(fmt.Sprintf("<br><b>%s:</b> %s", sub.usage(com.commandPrefix, cmd.Name+" "+sub.Name), sub.Help))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("<br><br>Type <b>%shelp <i>&lt;command&gt;</i></b> to see more about a command.", com.commandPrefix))
+	return sb.String()
 }
 
-// i don't like this either
-func (com *MusicPlayerCommandHandler) replyHelp() string {
+func (com *MusicPlayerCommandHandler) replyCommandHelp(args []string) string {
+	_, cmd, fullName, rest := com.resolveCommand(strings.TrimPrefix(args[0], com.commandPrefix), args[1:])
+	if cmd == nil {
+		return "Unknown command: " + html.EscapeString(args[0])
+	}
+	if len(rest) > 0 {
+		return fmt.Sprintf("Unknown %s command: %s", fullName, html.EscapeString(rest[0]))
+	}
 	var sb strings.Builder
-	sb.WriteString("<br><b>Available Commands:</b><br>")
-	sb.WriteString(fmt.Sprintf("<b>%shelp:</b> Show this help message.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%stracks <i>&lt;page number&gt;</i>:</b> Show available tracks. "+
-		"Invoke with no arguments to show the first page.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%sadd <i>&lt;track id&gt;</i>:</b> Add a track to playlist by its track ID.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%saddalbum <i>&lt;album name&gt;</i>:</b> Add an entire album to playlist.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%smode <i>&lt;playback mode&gt;</i>:</b> Set playback mode. "+
-		"Invoke with no arguments to see current plaback mode. "+
-		"Available values are: &quot;single&quot;, &quot;shuffle&quot;, &quot;repeat&quot;, &quot;shufflerepeat&quot;.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%sremove <i>&lt;index&gt;</i>:</b> Remove a track from playlist by its index in the playlist.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%sskip:</b> Skip the current track.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%snowplaying:</b> Show what's playing right now.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%splaylist:</b> Show the current playlist.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%sstart:</b> Start playback.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%sstop:</b> Stop playback and rewind to the first track in playlist.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%spause:</b> Pause/Unpause playback.<br>", com.commandPrefix))
-	sb.WriteString(fmt.Sprintf("<b>%sclear:</b> Stop playback and clear playlist.", com.commandPrefix))
+	sb.WriteString("<br><b>" + cmd.usage(com.commandPrefix, fullName) + "</b><br>" + cmd.Help)
+	if len(cmd.Aliases) > 0 {
+		sb.WriteString("<br><b>Aliases:</b> " + html.EscapeString(strings.Join(cmd.Aliases, ", ")))
+	}
+	sb.WriteString("<br><b>Required role:</b> " + RoleToString(cmd.Role))
+	if len(cmd.Subcommands) > 0 {
+		names := make([]string, 0, len(cmd.Subcommands))
+		for _, sub := range cmd.Subcommands {
+			names = append(names, sub.Name)
+		}
+		sb.WriteString("<br><b>Subcommands:</b> " + strings.Join(names, ", "))
+	}
 	return sb.String()
 }
 
 func (com *MusicPlayerCommandHandler) getTracks(args []string) string {
-	if len(com.allTracks) == 0 {
+	var total int64
+	if err := com.db.Model(&media.AudioData{}).Count(&total).Error; err != nil {
+		return "Database error while fetching tracks."
+	}
+	if total == 0 {
 		return "No tracks available."
 	}
 	var pageNum int
@@ -159,24 +576,103 @@ func (com *MusicPlayerCommandHandler) getTracks(args []string) string {
 			return "Not a valid page number."
 		}
 	}
-	if pageNum <= 0 || pageNum > len(com.allTrackPages) {
+	numPages := int(math.Ceil(float64(total) / float64(com.pageSize)))
+	if pageNum <= 0 || pageNum > numPages {
 		return "Page number out of range."
 	}
+	var page []media.AudioData
+	if err := com.db.Order("id").Limit(com.pageSize).Offset((pageNum - 1) * com.pageSize).Find(&page).Error; err != nil {
+		return "Database error while fetching tracks."
+	}
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("<br><b>Showing page %d of %d</b>:<br>", pageNum, len(com.allTrackPages)))
-	page := com.allTrackPages[pageNum-1]
-	startIndex := (pageNum - 1) * com.pageSize
+	sb.WriteString(fmt.Sprintf("<br><b>Showing page %d of %d</b>:<br>", pageNum, numPages))
 	lines := make([]string, 0, len(page))
-	for index, i := range page {
-		lines = append(lines, fmt.Sprintf("<b>%d:</b> %s", startIndex+index+1, i.ToString()))
+	for _, i := range page {
+		lines = append(lines, fmt.Sprintf("<b>%d:</b> %s", i.ID, i.ToString()))
 	}
 	sb.WriteString(strings.Join(lines, "<br>"))
-	if pageNum != len(com.allTrackPages) {
+	if pageNum != numPages {
 		sb.WriteString(fmt.Sprintf("<br><br>Type <b>%stracks %d</b> to see the next page.", com.commandPrefix, pageNum+1))
 	}
 	return sb.String()
 }
 
+func (com *MusicPlayerCommandHandler) searchTracks(args []string) string {
+	pageNum := 1
+	if len(args) > 1 {
+		var err error
+		pageNum, err = strconv.Atoi(args[1])
+		if err != nil {
+			return "Not a valid page number."
+		}
+	}
+	if pageNum <= 0 {
+		return "Page number out of range."
+	}
+
+	query := args[0]
+	tracks, total, err := media.SearchAudioData(com.db, query, com.pageSize, (pageNum-1)*com.pageSize)
+	if err != nil {
+		return "Database error while searching tracks."
+	}
+	if total == 0 {
+		return "No tracks found matching <b>" + html.EscapeString(query) + "</b>."
+	}
+	numPages := int(math.Ceil(float64(total) / float64(com.pageSize)))
+	if pageNum > numPages {
+		return "Page number out of range."
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("<br><b>Search results for %s, showing page %d of %d</b>:<br>",
+		html.EscapeString(query), pageNum, numPages))
+	lines := make([]string, 0, len(tracks))
+	for _, i := range tracks {
+		lines = append(lines, fmt.Sprintf("<b>%d:</b> %s", i.ID, i.ToString()))
+	}
+	sb.WriteString(strings.Join(lines, "<br>"))
+	if pageNum != numPages {
+		sb.WriteString(fmt.Sprintf("<br><br>Type <b>%ssearch &quot;%s&quot; %d</b> to see the next page.",
+			com.commandPrefix, html.EscapeString(query), pageNum+1))
+	}
+	return sb.String()
+}
+
+func (com *MusicPlayerCommandHandler) replyTrackInfo(args []string) string {
+	track, err := com.findTrack(args[0])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "Invalid track ID."
+	} else if err != nil {
+		return "Database error while fetching track."
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("<br><b>Track %d</b><br>", track.ID))
+	sb.WriteString("<b>Title:</b> " + track.Title)
+	writeField := func(name string, value *string) {
+		if value != nil {
+			sb.WriteString("<br><b>" + name + ":</b> " + *value)
+		}
+	}
+	writeNumField := func(name string, value *int) {
+		if value != nil {
+			sb.WriteString(fmt.Sprintf("<br><b>%s:</b> %d", name, *value))
+		}
+	}
+	writeField("Artists", track.Artists)
+	writeField("Album", track.Album)
+	writeField("Album artist", track.AlbumArtist)
+	writeField("Composer", track.Composer)
+	writeField("Genre", track.Genre)
+	writeNumField("Year", track.Year)
+	writeNumField("Disc", track.DiscNum)
+	writeNumField("Track", track.TrackNum)
+	if track.Duration != nil {
+		sb.WriteString("<br><b>Duration:</b> " + utils.FormatDuration(*track.Duration))
+	}
+	return sb.String()
+}
+
 func (com *MusicPlayerCommandHandler) replyNowPlaying() string {
 	current := com.mp.GetCurrentTrack()
 	if current == nil {
@@ -185,100 +681,143 @@ func (com *MusicPlayerCommandHandler) replyNowPlaying() string {
 	var sb strings.Builder
 	sb.WriteString("<b>Now playing:</b> ")
 	sb.WriteString(current.ToString())
+	if position, err := com.mp.GetPosition(); err == nil {
+		sb.WriteString(" <i>(at " + utils.FormatDuration(position) + ")</i>")
+	}
 	if com.mp.IsPaused() {
 		sb.WriteString(" <i>(Paused)</i>")
 	}
+	if thumbnail := com.mp.bot.CoverThumbnail(current); thumbnail != nil {
+		sb.WriteString("<br><img src=\"data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(thumbnail) + "\">")
+	}
 	return sb.String()
 }
 
 func (com *MusicPlayerCommandHandler) replyPlaylist() string {
 	nowPlaying := com.mp.GetCurrentTrack()
-	playlist := com.mp.GetPlaylist()
+	playlist := com.mp.GetQueuedTracks()
 	if len(playlist) == 0 {
 		return "Playlist is empty."
 	}
 	var sb strings.Builder
-	sb.WriteString("<br><b>Current playlist:</b><br>")
-	for index, i := range playlist {
-		sb.WriteString(fmt.Sprintf("<b>%d:</b> %s", index+1, i.ToString()))
-		if i == nowPlaying {
+	sb.WriteString("<br><b>Current playlist:</b> <i>(position: queue ID, track)</i><br>")
+	for index, queued := range playlist {
+		sb.WriteString(fmt.Sprintf("<b>%d:</b> [%d] %s", index+1, queued.ID, html.EscapeString(queued.Track.ToString())))
+		if queued.Track == nowPlaying {
 			sb.WriteString(" <i>(Now playing)</i>")
 			if com.mp.IsPaused() {
 				sb.WriteString(" <i>(Paused)</i>")
 			}
 		}
-		if index != len(com.mp.playlist)-1 {
+		if index != len(playlist)-1 {
 			sb.WriteString("<br>")
 		}
 	}
 	return sb.String()
 }
 
-func (com *MusicPlayerCommandHandler) addTrack(args []string) string {
-	trackId, err := strconv.Atoi(args[0])
-	if err != nil || trackId <= 0 || trackId > len(com.allTracks) {
-		return "Invalid track ID."
+func (com *MusicPlayerCommandHandler) savePlaylist(name string) string {
+	playlist := com.mp.GetPlaylist()
+	if len(playlist) == 0 {
+		return "Playlist is empty."
 	}
-	track := com.allTracks[trackId-1]
-	com.mp.AddToPlaylist(track)
-	return "<b>Adding track:</b> " + track.ToString()
+	if err := SavePlaylist(com.db, name, playlist); err != nil {
+		return "Database error while saving playlist."
+	}
+	return fmt.Sprintf("Saved playlist <b>%s</b>. (%d tracks)", html.EscapeString(name), len(playlist))
 }
 
-func (com *MusicPlayerCommandHandler) addAlbum(args []string) string {
-	if len(args) == 0 {
-		return "Album name needed."
+func (com *MusicPlayerCommandHandler) loadPlaylist(name string) string {
+	tracks, err := LoadPlaylistTracks(com.db, name)
+	if errors.Is(err, ErrPlaylistNotFound) {
+		return "No saved playlist named <b>" + html.EscapeString(name) + "</b>."
+	} else if err != nil {
+		return "Database error while loading playlist."
 	}
-	if len(com.allAlbums) == 0 {
-		return "No albums are in DB somehow."
+	if len(tracks) == 0 {
+		return "Saved playlist <b>" + html.EscapeString(name) + "</b> has no tracks."
 	}
+	com.mp.AddAllToPlaylist(tracks)
+	return fmt.Sprintf("Adding saved playlist <b>%s</b> to playlist. (%d tracks)", html.EscapeString(name), len(tracks))
+}
 
-	bestAlbum := ""
-	bestDistance := math.MaxInt
-	for _, a := range com.allAlbums {
-		dist := utils.Levenshtein(strings.ToLower(args[0]), strings.ToLower(a))
-		if dist < bestDistance {
-			bestDistance = dist
-			bestAlbum = a
-		}
+func (com *MusicPlayerCommandHandler) listSavedPlaylists() string {
+	playlists, err := ListPlaylists(com.db)
+	if err != nil {
+		return "Database error while fetching playlists."
+	}
+	if len(playlists) == 0 {
+		return "No saved playlists."
+	}
+	lines := make([]string, 0, len(playlists))
+	for _, p := range playlists {
+		lines = append(lines, fmt.Sprintf("<b>%s</b> (%d tracks)", html.EscapeString(p.Name), p.TrackCount))
+	}
+	return "<br><b>Saved playlists:</b><br>" + strings.Join(lines, "<br>")
+}
+
+func (com *MusicPlayerCommandHandler) showSavedPlaylist(name string) string {
+	tracks, err := LoadPlaylistTracks(com.db, name)
+	if errors.Is(err, ErrPlaylistNotFound) {
+		return "No saved playlist named <b>" + html.EscapeString(name) + "</b>."
+	} else if err != nil {
+		return "Database error while loading playlist."
+	}
+	if len(tracks) == 0 {
+		return "Saved playlist <b>" + html.EscapeString(name) + "</b> has no tracks."
+	}
+	lines := make([]string, 0, len(tracks))
+	for _, i := range tracks {
+		lines = append(lines, fmt.Sprintf("<b>%d:</b> %s", i.ID, i.ToString()))
+	}
+	return "<br><b>Saved playlist " + html.EscapeString(name) + ":</b><br>" + strings.Join(lines, "<br>")
+}
+
+func (com *MusicPlayerCommandHandler) deleteSavedPlaylist(name string) string {
+	err := DeletePlaylist(com.db, name)
+	if errors.Is(err, ErrPlaylistNotFound) {
+		return "No saved playlist named <b>" + html.EscapeString(name) + "</b>."
+	} else if err != nil {
+		return "Database error while deleting playlist."
 	}
-	if bestAlbum == "" {
-		return "No matching album found."
+	return "Deleted saved playlist <b>" + html.EscapeString(name) + "</b>."
+}
+
+func (com *MusicPlayerCommandHandler) addTrack(args []string) string {
+	track, err := com.findTrack(args[0])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "Invalid track ID."
+	} else if err != nil {
+		return "Database error while fetching track."
 	}
+	com.mp.AddToPlaylist(*track)
+	return "<b>Adding track:</b> " + track.ToString()
+}
 
-	var tracks []media.AudioData
-	if err := com.db.
-		Where("album = ?", bestAlbum).
-		Order("CASE WHEN disc_num IS NULL THEN 1 ELSE 0 END, disc_num").
-		Order("CASE WHEN track_num IS NULL THEN 1 ELSE 0 END, track_num").
-		Order("title COLLATE NOCASE ASC").
-		Find(&tracks).Error; err != nil {
+func (com *MusicPlayerCommandHandler) addAlbum(args []string) string {
+	album, reply := com.findAlbum(args[0])
+	if album == nil {
+		return reply
+	}
+	tracks, err := media.FindAlbumTracks(com.db, album.Album, album.Artist)
+	if err != nil {
 		return "Database error while fetching album tracks."
 	}
 	if len(tracks) == 0 {
-		return "No tracks found for album " + bestAlbum
+		return "No tracks found for album " + html.EscapeString(album.FullName())
 	}
 
 	com.mp.AddAllToPlaylist(tracks)
-	return fmt.Sprintf("Adding album <b>%s</b> to playlist. (%d tracks)", bestAlbum, len(tracks))
+	return fmt.Sprintf("Adding album <b>%s</b> to playlist. (%d tracks)", html.EscapeString(album.FullName()), len(tracks))
 }
 
 func (com *MusicPlayerCommandHandler) setOrGetMode(args []string) string {
 	if len(args) == 0 {
 		return "<b>Current playback mode:</b> " + PlaybackModeToString(com.mp.GetMode())
 	}
-	modeStr := strings.ToLower(args[0])
-	var mode PlaybackMode
-	switch modeStr {
-	case "single":
-		mode = Single
-	case "shuffle":
-		mode = Shuffle
-	case "repeat":
-		mode = Repeat
-	case "shufflerepeat":
-		mode = ShuffleRepeat
-	default:
-		return "Invalid playback mode: " + modeStr
+	mode, ok := ParsePlaybackMode(args[0])
+	if !ok {
+		return "Invalid playback mode: " + html.EscapeString(args[0])
 	}
 	com.mp.SetMode(mode)
 	return "<b>Changed playback mode to:</b> " + PlaybackModeToString(mode)
@@ -288,28 +827,30 @@ func (com *MusicPlayerCommandHandler) removeFromPlaylist(args []string) string {
 	if len(com.mp.GetPlaylist()) == 0 {
 		return "Playlist is empty."
 	}
-	playlistIndex, err := strconv.Atoi(args[0])
-	if err != nil {
-		return "Invalid index."
+	queueId, err := strconv.Atoi(args[0])
+	if err != nil || queueId <= 0 {
+		return "Invalid queue ID."
 	}
-	playlistIndex--
 
-	removedTrack, result := com.mp.RemoveFromPlaylist(playlistIndex)
+	removedTrack, result := com.mp.RemoveQueuedTrack(queueId)
 	switch result {
 	case Success:
-		return fmt.Sprintf("Removed track <b>%d: %s</b> from playlist.", playlistIndex+1, removedTrack.Title)
+		return fmt.Sprintf("Removed <b>[%d] %s</b> from playlist.", queueId, html.EscapeString(removedTrack.Title))
 	case Playing:
 		return "You can't remove the track that's currently playing."
 	case OutOfRange:
-		return "Invalid index."
+		return "That track is not in the playlist."
 	}
 	return ""
 }
 
-func (com *MusicPlayerCommandHandler) skipTrack() string {
+func (com *MusicPlayerCommandHandler) skipTrack(sender *CommandSender) string {
 	if len(com.mp.GetPlaylist()) == 0 {
 		return "Playlist is empty."
 	}
+	if com.voteSkip {
+		return com.voteSkipTrack(sender)
+	}
 	if err := com.mp.Skip(); err == nil {
 		return "Skipping track."
 	}
@@ -355,3 +896,368 @@ func (com *MusicPlayerCommandHandler) pauseToggle() string {
 	com.mp.Unpause()
 	return "Unpausing audio."
 }
+
+func formatScanProgress(progress media.ScanProgress) string {
+	return fmt.Sprintf("%d files walked, %d added, %d updated, %d removed, %d failed",
+		progress.Walked, progress.Added, progress.Updated, progress.Removed, progress.Failed)
+}
+
+func (com *MusicPlayerCommandHandler) rescanLibrary() string {
+	if com.scanner == nil {
+		return "Rescanning is not available."
+	}
+	if com.scanner.IsScanning() {
+		return "A rescan is already in progress."
+	}
+
+	// this runs under com.mu, the goroutine outlives it so it only uses what's copied here
+	scanner, musicPath, mb := com.scanner, com.musicPath, com.mp.bot
+	go func() {
+		start := time.Now()
+		progress, err := scanner.ScanAndWriteToDbWithProgress(musicPath, func(progress media.ScanProgress) {
+			mb.SendChannelMessage("<b>Rescan progress:</b> " + formatScanProgress(progress))
+		})
+		if errors.Is(err, media.ErrScanInProgress) {
+			return
+		}
+		if err != nil {
+			log.Println("Rescan failed: ", err)
+			mb.SendChannelMessage("Rescan failed: " + html.EscapeString(err.Error()))
+			return
+		}
+		mb.SendChannelMessage(fmt.Sprintf("<b>Rescan finished in %s:</b> %s",
+			time.Since(start).Round(time.Second), formatScanProgress(progress)))
+	}()
+	return "Rescanning music library in the background."
+}
+
+func (com *MusicPlayerCommandHandler) seekTo(args []string) string {
+	if com.mp.GetCurrentTrack() == nil {
+		return "Not playing anything right now."
+	}
+	offset, err := utils.ParseTimestamp(args[0])
+	if err != nil {
+		return "Invalid position, use mm:ss."
+	}
+	if err := com.mp.Seek(offset); err != nil {
+		return "Not playing anything right now."
+	}
+	return "Seeking to " + utils.FormatDuration(offset) + "."
+}
+
+func (com *MusicPlayerCommandHandler) seekBy(args []string, direction int) string {
+	if com.mp.GetCurrentTrack() == nil {
+		return "Not playing anything right now."
+	}
+	seconds, err := strconv.Atoi(args[0])
+	if err != nil || seconds <= 0 {
+		return "Invalid number of seconds."
+	}
+	position, err := com.mp.GetPosition()
+	if err != nil {
+		return "Not playing anything right now."
+	}
+	offset := max(position+time.Duration(direction*seconds)*time.Second, 0)
+	if err := com.mp.Seek(offset); err != nil {
+		return "Not playing anything right now."
+	}
+	return "Seeking to " + utils.FormatDuration(offset) + "."
+}
+
+func (com *MusicPlayerCommandHandler) setOrGetVolume(args []string) string {
+	if len(args) == 0 {
+		return fmt.Sprintf("<b>Current volume:</b> %d", com.mp.GetVolume())
+	}
+	volume, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+	if err != nil || volume < 0 || volume > 100 {
+		return "Volume must be a number from 0 to 100."
+	}
+	com.mp.SetVolume(volume)
+	if err := saveSetting(com.db, volumeSettingKey, strconv.Itoa(volume)); err != nil {
+		log.Println("Failed to save volume: ", err)
+	}
+	return fmt.Sprintf("<b>Changed volume to:</b> %d", volume)
+}
+
+func (com *MusicPlayerCommandHandler) setOrGetNormalizeMode(args []string) string {
+	if len(args) == 0 {
+		return "<b>Current normalization mode:</b> " + NormalizeModeToString(com.mp.GetNormalizeMode())
+	}
+	modeStr := strings.ToLower(args[0])
+	var mode NormalizeMode
+	switch modeStr {
+	case "off":
+		mode = NormalizeOff
+	case "track":
+		mode = NormalizeTrack
+	case "album":
+		mode = NormalizeAlbum
+	default:
+		return "Invalid normalization mode: " + html.EscapeString(modeStr)
+	}
+	com.mp.SetNormalizeMode(mode)
+	if err := saveSetting(com.db, normalizeSettingKey, strconv.Itoa(int(mode))); err != nil {
+		log.Println("Failed to save normalization mode: ", err)
+	}
+	return "<b>Changed normalization mode to:</b> " + NormalizeModeToString(mode)
+}
+
+func (com *MusicPlayerCommandHandler) listPlaylistFiles() string {
+	var files []media.PlaylistFile
+	if err := com.db.Order("name COLLATE NOCASE ASC").Find(&files).Error; err != nil {
+		return "Database error while fetching playlist files."
+	}
+	if len(files) == 0 {
+		return "No playlist files found in the music library."
+	}
+	lines := make([]string, 0, len(files))
+	for _, f := range files {
+		lines = append(lines, html.EscapeString(f.Name))
+	}
+	return "<br><b>Playlist files:</b><br>" + strings.Join(lines, "<br>")
+}
+
+func (com *MusicPlayerCommandHandler) loadPlaylistFile(args []string) string {
+	if len(args) == 0 {
+		return com.listPlaylistFiles()
+	}
+	var files []media.PlaylistFile
+	if err := com.db.Find(&files).Error; err != nil {
+		return "Database error while fetching playlist files."
+	}
+	if len(files) == 0 {
+		return "No playlist files found in the music library."
+	}
+
+	var best *media.PlaylistFile
+	bestDistance := math.MaxInt
+	for index, f := range files {
+		if strings.EqualFold(f.Name, args[0]) {
+			best = &files[index]
+			break
+		}
+		dist := utils.Levenshtein(strings.ToLower(args[0]), strings.ToLower(f.Name))
+		if dist < bestDistance {
+			bestDistance = dist
+			best = &files[index]
+		}
+	}
+
+	paths, err := media.ReadPlaylistFile(best.Path)
+	if err != nil {
+		return "Failed to read playlist file <b>" + html.EscapeString(best.Name) + "</b>."
+	}
+	tracks, missing, err := media.FindAudioDataByPaths(com.db, paths)
+	if err != nil {
+		return "Database error while fetching playlist tracks."
+	}
+	if len(tracks) == 0 {
+		return "None of the tracks in <b>" + html.EscapeString(best.Name) + "</b> are in the music library."
+	}
+
+	com.mp.AddAllToPlaylist(tracks)
+	result := fmt.Sprintf("Adding playlist file <b>%s</b> to playlist. (%d tracks)", html.EscapeString(best.Name), len(tracks))
+	if missing > 0 {
+		result += fmt.Sprintf(" <i>%d entries could not be found in the library.</i>", missing)
+	}
+	return result
+}
+
+func (com *MusicPlayerCommandHandler) exportQueue(args []string) string {
+	if com.exportPath == "" {
+		return "Exporting playlists is not available."
+	}
+	format := strings.ToLower(args[0])
+	if !slices.Contains(media.PlaylistFormats, format) {
+		return "Invalid playlist format: " + html.EscapeString(format)
+	}
+	playlist := com.mp.GetPlaylist()
+	if len(playlist) == 0 {
+		return "Playlist is empty."
+	}
+
+	name := "queue-" + time.Now().Format("20060102-150405")
+	if len(args) > 1 {
+		name = args[1]
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "Invalid playlist name."
+	}
+
+	tracks := make([]media.AudioData, 0, len(playlist))
+	for _, t := range playlist {
+		tracks = append(tracks, *t)
+	}
+	path := filepath.Join(com.exportPath, name+"."+format)
+	// someone may have put work into the playlist that's already there
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Sprintf("A playlist file named <b>%s</b> already exists.", html.EscapeString(name+"."+format))
+	}
+	// written somewhere else first so the watcher never picks up half a playlist
+	tmp, err := os.CreateTemp(com.exportPath, "."+name+".*.tmp")
+	if err != nil {
+		log.Println("Failed to create playlist file: ", err)
+		return "Failed to create playlist file."
+	}
+	defer os.Remove(tmp.Name())
+	if err := media.WritePlaylist(tmp, format, tracks, com.exportPath, name); err != nil {
+		tmp.Close()
+		log.Println("Failed to write playlist file: ", err)
+		return "Failed to write playlist file."
+	}
+	if err := tmp.Close(); err != nil {
+		log.Println("Failed to write playlist file: ", err)
+		return "Failed to write playlist file."
+	}
+	// temp files are private, a playlist should be readable like the music next to it
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		log.Println("Failed to write playlist file: ", err)
+		return "Failed to write playlist file."
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		log.Println("Failed to write playlist file: ", err)
+		return "Failed to write playlist file."
+	}
+	return fmt.Sprintf("Exported playlist to <b>%s</b>. (%d tracks)", html.EscapeString(path), len(tracks))
+}
+
+func (com *MusicPlayerCommandHandler) grantRole(args []string) string {
+	role, ok := ParseRole(args[1])
+	if !ok {
+		return "Invalid role: " + html.EscapeString(args[1])
+	}
+	user := com.mp.bot.FindUser(args[0])
+	if user == nil {
+		return "No user named <b>" + html.EscapeString(args[0]) + "</b> is connected."
+	}
+	if user.CertHash == "" && !user.IsRegistered() {
+		return "<b>" + html.EscapeString(user.Name) + "</b> has no certificate and isn't registered, so they can't be given a role."
+	}
+	if err := grantRole(com.db, user, role); err != nil {
+		return "Database error while granting role."
+	}
+	return fmt.Sprintf("Gave <b>%s</b> the role <b>%s</b>.", html.EscapeString(user.Name), RoleToString(role))
+}
+
+func (com *MusicPlayerCommandHandler) revokeRole(args []string) string {
+	user := com.mp.bot.FindUser(args[0])
+	if user == nil {
+		return "No user named <b>" + html.EscapeString(args[0]) + "</b> is connected."
+	}
+	revoked, err := revokeRole(com.db, user)
+	if err != nil {
+		return "Database error while revoking role."
+	}
+	if !revoked {
+		return "<b>" + html.EscapeString(user.Name) + "</b> has not been given a role."
+	}
+	return "Revoked the role of <b>" + html.EscapeString(user.Name) + "</b>."
+}
+
+func (com *MusicPlayerCommandHandler) replyRoles() string {
+	var roles []UserRole
+	if err := com.db.Order("role DESC").Order("name COLLATE NOCASE ASC").Find(&roles).Error; err != nil {
+		return "Database error while fetching roles."
+	}
+	var sb strings.Builder
+	sb.WriteString("<br><b>Default role:</b> " + RoleToString(com.defaultRole))
+	for _, r := range roles {
+		sb.WriteString(fmt.Sprintf("<br><b>%s:</b> %s", html.EscapeString(r.Name), RoleToString(r.Role)))
+	}
+	return sb.String()
+}
+
+func voterKey(sender *CommandSender) string {
+	if sender == nil {
+		return ""
+	}
+	if sender.CertHash != "" {
+		return sender.CertHash
+	}
+	return "name:" + sender.Name
+}
+
+func (com *MusicPlayerCommandHandler) votesNeeded() int {
+	return max(int(math.Ceil(float64(com.mp.bot.CountListeners())*com.voteSkipRatio)), 1)
+}
+
+func (com *MusicPlayerCommandHandler) voteSkipTrack(sender *CommandSender) string {
+	needed := com.votesNeeded()
+	votes, skipped, err := com.mp.VoteSkip(voterKey(sender), needed)
+	if err != nil {
+		return "Not playing anything right now."
+	}
+	if skipped {
+		return fmt.Sprintf("Vote passed (%d/%d), skipping track.", votes, needed)
+	}
+	return fmt.Sprintf("Voted to skip. (%d/%d)", votes, needed)
+}
+
+func (com *MusicPlayerCommandHandler) setOrGetVoteSkip(args []string) string {
+	if len(args) == 0 {
+		if !com.voteSkip {
+			return "<b>Vote skipping:</b> Off"
+		}
+		return fmt.Sprintf("<b>Vote skipping:</b> On, %d%% of listeners needed", int(math.Round(com.voteSkipRatio*100)))
+	}
+	switch strings.ToLower(args[0]) {
+	case "on":
+		com.voteSkip = true
+	case "off":
+		com.voteSkip = false
+	default:
+		percent, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+		if err != nil || percent <= 0 || percent > 100 {
+			return "Percentage must be a number from 1 to 100."
+		}
+		com.voteSkip = true
+		com.voteSkipRatio = float64(percent) / 100
+		if err := saveSetting(com.db, voteSkipRatioSettingKey, strconv.FormatFloat(com.voteSkipRatio, 'f', -1, 64)); err != nil {
+			log.Println("Failed to save vote skip ratio: ", err)
+		}
+	}
+	if err := saveSetting(com.db, voteSkipSettingKey, strconv.FormatBool(com.voteSkip)); err != nil {
+		log.Println("Failed to save vote skip setting: ", err)
+	}
+	return com.setOrGetVoteSkip(nil)
+}
+
+func replyTargetToString(target ReplyTarget) string {
+	switch target {
+	case ReplyChannel:
+		return "Channel"
+	case ReplySender:
+		return "Sender"
+	default:
+		return ""
+	}
+}
+
+func (com *MusicPlayerCommandHandler) setOrGetReplyTarget(args []string) string {
+	cmd := com.registry.Lookup(strings.TrimPrefix(args[0], com.commandPrefix))
+	if cmd == nil {
+		return "Unknown command: " + html.EscapeString(args[0])
+	}
+	verb := cmd.Name
+	if len(args) == 1 {
+		target := com.replyTarget(cmd, cmd, &CommandContext{Handler: com})
+		return fmt.Sprintf("Replies to <b>%s</b> go to: <b>%s</b>", verb, replyTargetToString(target))
+	}
+	var target ReplyTarget
+	switch strings.ToLower(args[1]) {
+	case "channel":
+		target = ReplyChannel
+	case "sender":
+		target = ReplySender
+	default:
+		return "Invalid reply target: " + html.EscapeString(args[1])
+	}
+	if com.replyTargets == nil {
+		com.replyTargets = make(map[string]ReplyTarget)
+	}
+	com.replyTargets[verb] = target
+	if err := saveSetting(com.db, replyTargetSettingPrefix+verb, strconv.Itoa(int(target))); err != nil {
+		log.Println("Failed to save reply target: ", err)
+	}
+	return fmt.Sprintf("Replies to <b>%s</b> now go to: <b>%s</b>", verb, replyTargetToString(target))
+}
@@ -0,0 +1,149 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrCommandExists  = errors.New("A command with that name already exists.")
+	ErrInvalidCommand = errors.New("Commands need a name and something to run.")
+)
+
+type CommandArg struct {
+	Name     string
+	Optional bool
+	// takes every remaining word, so names with spaces don't need quotes
+	Rest bool
+}
+
+type CommandContext struct {
+	Handler *MusicPlayerCommandHandler
+	Sender  *CommandSender
+	Args    []string
+}
+
+type Command struct {
+	Name        string
+	Aliases     []string
+	Args        []CommandArg
+	Help        string
+	Role        Role
+	Subcommands []*Command
+	// overrides Role, for commands that only change things when given arguments
+	Permission func(ctx *CommandContext) Role
+	// replies go to the sender instead of the channel when it's run as a listener
+	SenderReply bool
+	Run         func(ctx *CommandContext) string
+}
+
+func (cmd *Command) requiredRole(ctx *CommandContext) Role {
+	if cmd.Permission != nil {
+		return cmd.Permission(ctx)
+	}
+	return cmd.Role
+}
+
+func (cmd *Command) findSubcommand(name string) *Command {
+	name = strings.ToLower(name)
+	for _, sub := range cmd.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+		for _, alias := range sub.Aliases {
+			if alias == name {
+				return sub
+			}
+		}
+	}
+	return nil
+}
+
+func (cmd *Command) argRange() (int, int) {
+	minArgs := 0
+	for _, arg := range cmd.Args {
+		if arg.Rest {
+			if !arg.Optional {
+				minArgs++
+			}
+			return minArgs, -1
+		}
+		if !arg.Optional {
+			minArgs++
+		}
+	}
+	return minArgs, len(cmd.Args)
+}
+
+// joins the words taken by a rest argument into one, the count has to be validated already
+func (cmd *Command) collectArgs(args []string) []string {
+	if len(cmd.Args) == 0 || !cmd.Args[len(cmd.Args)-1].Rest || len(args) < len(cmd.Args) {
+		return args
+	}
+	last := len(cmd.Args) - 1
+	return append(args[:last:last], strings.Join(args[last:], " "))
+}
+
+func (cmd *Command) validateArgs(args []string) bool {
+	minArgs, maxArgs := cmd.argRange()
+	return len(args) >= minArgs && (maxArgs < 0 || len(args) <= maxArgs)
+}
+
+// fullName includes the parent command for subcommands
+func (cmd *Command) usage(prefix, fullName string) string {
+	var sb strings.Builder
+	sb.WriteString(prefix + fullName)
+	for _, arg := range cmd.Args {
+		if arg.Optional {
+			sb.WriteString(" <i>[" + html.EscapeString(arg.Name) + "]</i>")
+		} else {
+			sb.WriteString(" <i>&lt;" + html.EscapeString(arg.Name) + "&gt;</i>")
+		}
+	}
+	return sb.String()
+}
+
+type CommandRegistry struct {
+	commands []*Command
+	byName   map[string]*Command
+	mu       sync.RWMutex
+}
+
+func CreateCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{byName: make(map[string]*Command)}
+}
+
+func (reg *CommandRegistry) Register(cmd *Command) error {
+	if cmd.Name == "" || cmd.Run == nil {
+		return ErrInvalidCommand
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		if _, ok := reg.byName[strings.ToLower(name)]; ok {
+			return fmt.Errorf("%w (%s)", ErrCommandExists, name)
+		}
+	}
+	for _, name := range names {
+		reg.byName[strings.ToLower(name)] = cmd
+	}
+	reg.commands = append(reg.commands, cmd)
+	return nil
+}
+
+func (reg *CommandRegistry) Lookup(name string) *Command {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.byName[strings.ToLower(name)]
+}
+
+// in the order they were registered
+func (reg *CommandRegistry) Commands() []*Command {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return append([]*Command(nil), reg.commands...)
+}
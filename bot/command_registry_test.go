@@ -0,0 +1,117 @@
+package bot_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/internal/testutil"
+)
+
+func noop(ctx *bot.CommandContext) string {
+	return ""
+}
+
+func TestCommandRegistry(t *testing.T) {
+	reg := bot.CreateCommandRegistry()
+	play := &bot.Command{Name: "play", Aliases: []string{"p"}, Run: noop}
+	if err := reg.Register(play); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		cmd  *bot.Command
+		want error
+	}{
+		{&bot.Command{Name: "stop", Run: noop}, nil},
+		{&bot.Command{Name: "play", Run: noop}, bot.ErrCommandExists},
+		{&bot.Command{Name: "Play", Run: noop}, bot.ErrCommandExists},
+		{&bot.Command{Name: "pause", Aliases: []string{"P"}, Run: noop}, bot.ErrCommandExists},
+		{&bot.Command{Name: "", Run: noop}, bot.ErrInvalidCommand},
+		{&bot.Command{Name: "skip"}, bot.ErrInvalidCommand},
+	} {
+		if err := reg.Register(tc.cmd); !errors.Is(err, tc.want) {
+			t.Errorf("registering %q: got %v, want %v", tc.cmd.Name, err, tc.want)
+		}
+	}
+	// a failed registration doesn't leave its aliases behind
+	if reg.Lookup("pause") != nil {
+		t.Error("pause shouldn't be registered")
+	}
+
+	for _, tc := range []struct {
+		name string
+		want *bot.Command
+	}{
+		{"play", play},
+		{"PLAY", play},
+		{"p", play},
+		{"P", play},
+		{"unknown", nil},
+	} {
+		if got := reg.Lookup(tc.name); got != tc.want {
+			t.Errorf("lookup %q: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	var names []string
+	for _, cmd := range reg.Commands() {
+		names = append(names, cmd.Name)
+	}
+	if strings.Join(names, ",") != "play,stop" {
+		t.Errorf("unexpected commands: %v", names)
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	player := testutil.NewPlayer(t)
+	handler := bot.CreateCommandHandler("!", player.MusicPlayer, player.DB)
+	echo := func(ctx *bot.CommandContext) string { return strings.Join(ctx.Args, "|") }
+	for _, cmd := range []*bot.Command{
+		{Name: "echo", Args: []bot.CommandArg{{Name: "first"}, {Name: "rest", Optional: true, Rest: true}}, Run: echo},
+		{Name: "pair", Args: []bot.CommandArg{{Name: "first"}, {Name: "second", Optional: true}}, Run: echo},
+		{Name: "group", Run: echo, Subcommands: []*bot.Command{
+			{Name: "add", Aliases: []string{"a"}, Args: []bot.CommandArg{{Name: "name"}}, Run: echo},
+		}},
+		{Name: "secret", Role: bot.RoleAdmin, Run: echo},
+	} {
+		if err := handler.RegisterCommand(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sender := &bot.CommandSender{Name: "tester"}
+	for _, tc := range []struct {
+		command string
+		want    string
+	}{
+		{"!echo a", "a"},
+		{"!ECHO a", "a"},
+		{"!echo a b  c", "a|b c"},
+		{`!echo "a b"`, "a b"},
+		{"!echo", "<b>Usage:</b> !echo <i>&lt;first&gt;</i> <i>[rest]</i>"},
+		{"!pair a", "a"},
+		{"!pair a b", "a|b"},
+		{"!pair a b c", "<b>Usage:</b> !pair <i>&lt;first&gt;</i> <i>[second]</i>"},
+		{"!group add x", "x"},
+		{"!group a x", "x"},
+		{"!group add", "<b>Usage:</b> !group add <i>&lt;name&gt;</i>"},
+		{"!group remove x", "Unknown group command: remove"},
+		{"!secret", "You don't have permission to do that."},
+	} {
+		reply := handler.HandleCommand(sender, tc.command)
+		if reply == nil {
+			t.Errorf("%q: no reply", tc.command)
+			continue
+		}
+		if reply.Message != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.command, reply.Message, tc.want)
+		}
+	}
+	for _, command := range []string{"echo a", "!unknown", "!"} {
+		if reply := handler.HandleCommand(sender, command); reply != nil {
+			t.Errorf("%q: expected no reply, got %q", command, reply.Message)
+		}
+	}
+}
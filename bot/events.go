@@ -0,0 +1,119 @@
+package bot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/EricZhang456/mumble-music-bot/media"
+)
+
+// events are dropped for subscribers that fall this far behind
+const eventBufferSize = 64
+
+type Event interface {
+	EventName() string
+}
+
+type TrackStartedEvent struct {
+	Track  *media.AudioData
+	Index  int
+	Offset time.Duration
+}
+
+type TrackFinishedEvent struct {
+	Track *media.AudioData
+}
+
+type TrackSkippedEvent struct {
+	Track *media.AudioData
+}
+
+type PlaybackStoppedEvent struct{}
+
+type PausedEvent struct {
+	Track    *media.AudioData
+	Position time.Duration
+}
+
+type ResumedEvent struct {
+	Track    *media.AudioData
+	Position time.Duration
+}
+
+type QueueChangedEvent struct {
+	Length int
+}
+
+type ModeChangedEvent struct {
+	Mode PlaybackMode
+}
+
+type CommandResult string
+
+const (
+	CommandOK     CommandResult = "ok"
+	CommandDenied CommandResult = "denied"
+	CommandUsage  CommandResult = "usage"
+)
+
+type CommandIssuedEvent struct {
+	Sender  string
+	Command string
+	Args    []string
+	Result  CommandResult
+}
+
+// ffmpeg couldn't play a track
+type PlaybackErrorEvent struct {
+	Track *media.AudioData
+	Err   error
+}
+
+func (TrackStartedEvent) EventName() string    { return "track_started" }
+func (TrackFinishedEvent) EventName() string   { return "track_finished" }
+func (TrackSkippedEvent) EventName() string    { return "track_skipped" }
+func (PlaybackStoppedEvent) EventName() string { return "playback_stopped" }
+func (PausedEvent) EventName() string          { return "paused" }
+func (ResumedEvent) EventName() string         { return "resumed" }
+func (QueueChangedEvent) EventName() string    { return "queue_changed" }
+func (ModeChangedEvent) EventName() string     { return "mode_changed" }
+func (CommandIssuedEvent) EventName() string   { return "command_issued" }
+func (PlaybackErrorEvent) EventName() string   { return "playback_error" }
+
+type EventBus struct {
+	subscribers map[chan Event]struct{}
+	mu          sync.Mutex
+}
+
+func CreateEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+// the returned function unsubscribes and closes the channel
+func (eb *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	eb.mu.Lock()
+	eb.subscribers[ch] = struct{}{}
+	eb.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			eb.mu.Lock()
+			delete(eb.subscribers, ch)
+			eb.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// never blocks, so it's safe to call with locks held
+func (eb *EventBus) Publish(event Event) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	for ch := range eb.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
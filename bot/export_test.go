@@ -0,0 +1,35 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+// internals the bot_test package needs
+
+func (com *MusicPlayerCommandHandler) ResolveRole(sender *CommandSender) Role {
+	return com.resolveRole(sender)
+}
+
+// what happens when the next track starts, run right away instead of in a goroutine
+func (mp *MusicPlayer) PlayNext() {
+	mp.playNext()
+}
+
+// StartPlaylist plays in a goroutine, a bot that never connects ends up suspended once it's done
+func (mp *MusicPlayer) WaitUntilSuspended(t testing.TB) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mp.mu.Lock()
+		suspended := mp.suspended
+		mp.mu.Unlock()
+		if suspended {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("playback never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
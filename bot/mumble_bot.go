@@ -1,11 +1,17 @@
 package bot
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"log"
+	"math"
+	"net"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/EricZhang456/mumble-music-bot/media"
 	"layeh.com/gumble/gumble"
@@ -15,58 +21,249 @@ import (
 )
 
 type MumbleBot struct {
-	client           *gumble.Client
-	config           *gumble.Config
-	currentAudioData *media.AudioData
-	currentStream    *gumbleffmpeg.Stream
-	commandHandler   CommandHandler
-	mu               sync.Mutex
-	paused           bool
+	client            *gumble.Client
+	config            *gumble.Config
+	tlsConfig         *tls.Config
+	currentAudioData  *media.AudioData
+	currentStream     *gumbleffmpeg.Stream
+	currentOffset     time.Duration
+	replacedStreams   map[*gumbleffmpeg.Stream]struct{}
+	onComplete        func()
+	commandHandler    CommandHandler
+	mu                sync.Mutex
+	paused            bool
+	volume            float32
+	normalizeMode     NormalizeMode
+	targetHost        string
+	channelName       string
+	reconnecting      bool
+	registerSelf      bool
+	onConnectionLost  func()
+	onReconnect       func()
+	userGroups        map[uint32][]string
+	texturePath       string
+	textureSet        bool
+	pendingNowPlaying *nowPlayingUpdate
+	sendingNowPlaying bool
+	coverCache        *media.CoverCache
+	events            *EventBus
+	stats             StatsRecorder
 }
 
-type MumbleOptions func(*gumble.Config)
+const (
+	reconnectInitialDelay = time.Second
+	reconnectMaxDelay     = 2 * time.Minute
+)
+
+type NormalizeMode int
+
+// normalized audio plays below full scale so quiet tracks have room to be turned up, in dB
+const normalizeHeadroom = -6.0
+
+const (
+	NormalizeOff NormalizeMode = iota
+	NormalizeTrack
+	NormalizeAlbum
+)
+
+type MumbleOptions func(*gumble.Config, *tls.Config)
 
 func WithPassword(password string) MumbleOptions {
-	return func(c *gumble.Config) {
+	return func(c *gumble.Config, _ *tls.Config) {
 		c.Password = password
 	}
 }
 
 func WithTokens(tokens []string) MumbleOptions {
-	return func(c *gumble.Config) {
+	return func(c *gumble.Config, _ *tls.Config) {
 		c.Tokens = tokens
 	}
 }
 
+// present a client certificate, this is what makes the bot a registered user
+func WithCertificate(cert tls.Certificate) MumbleOptions {
+	return func(_ *gumble.Config, t *tls.Config) {
+		t.Certificates = append(t.Certificates, cert)
+	}
+}
+
+// trust these CAs instead of the system ones when verifying the server
+func WithRootCAs(pool *x509.CertPool) MumbleOptions {
+	return func(_ *gumble.Config, t *tls.Config) {
+		t.RootCAs = pool
+	}
+}
+
+// only accept a server certificate with this SHA-1 or SHA-256 fingerprint, works with self-signed servers
+func WithServerFingerprint(fingerprint string) MumbleOptions {
+	return func(_ *gumble.Config, t *tls.Config) {
+		t.InsecureSkipVerify = true
+		t.VerifyPeerCertificate = verifyFingerprint(fingerprint)
+	}
+}
+
+// don't verify the server certificate at all
+func WithInsecureSkipVerify() MumbleOptions {
+	return func(_ *gumble.Config, t *tls.Config) {
+		t.InsecureSkipVerify = true
+	}
+}
+
 func CreateMumbleBot(username string, opts ...MumbleOptions) *MumbleBot {
 	cfg := gumble.NewConfig()
 	cfg.Username = username
+	tlsCfg := &tls.Config{}
 	for _, opt := range opts {
-		opt(cfg)
+		opt(cfg, tlsCfg)
 	}
-	bot := &MumbleBot{config: cfg}
+	bot := &MumbleBot{config: cfg, tlsConfig: tlsCfg, events: CreateEventBus()}
+	bot.replacedStreams = make(map[*gumbleffmpeg.Stream]struct{})
 	bot.paused = false
+	bot.volume = 1.0
 	cfg.Attach(gumbleutil.Listener{
-		TextMessage: bot.onTextMessage,
+		TextMessage:      bot.onTextMessage,
+		Disconnect:       bot.onDisconnect,
+		ACL:              bot.onACL,
+		PermissionDenied: bot.onPermissionDenied,
 	})
 	return bot
 }
 
-func (bot *MumbleBot) Connect(host string, port int) {
-	targetHost := host + ":" + strconv.Itoa(port)
-	var err error
-	bot.client, err = gumble.Dial(targetHost, bot.config)
+func (bot *MumbleBot) Connect(host string, port int) error {
+	bot.mu.Lock()
+	bot.targetHost = host + ":" + strconv.Itoa(port)
+	bot.mu.Unlock()
+	return bot.dial()
+}
+
+func (bot *MumbleBot) dial() error {
+	bot.mu.Lock()
+	targetHost := bot.targetHost
+	bot.mu.Unlock()
+
+	// listeners are attached to the config, so a new client gets them too
+	client, err := gumble.DialWithDialer(new(net.Dialer), targetHost, bot.config, bot.tlsConfig)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	bot.mu.Lock()
+	bot.client = client
+	// the new session starts without an avatar
+	bot.textureSet = false
+	bot.mu.Unlock()
+	return nil
 }
 
+// the channel is remembered and joined again after reconnecting
 func (bot *MumbleBot) JoinChannel(channel string) {
-	ch := bot.client.Channels.Find(channel)
+	bot.mu.Lock()
+	bot.channelName = channel
+	client := bot.client
+	bot.mu.Unlock()
+	if client == nil {
+		return
+	}
+
+	ch := client.Channels.Find(channel)
 	if ch == nil {
 		return
 	}
-	bot.client.Self.Move(ch)
+	client.Self.Move(ch)
+	// for group based roles, needs the Write ACL permission on the channel or the server refuses
+	ch.RequestACL()
+}
+
+// needs a client certificate and permission to register on the server
+func (bot *MumbleBot) RegisterSelf() {
+	bot.mu.Lock()
+	bot.registerSelf = true
+	client := bot.client
+	bot.mu.Unlock()
+	if client == nil || client.Self == nil || client.Self.IsRegistered() {
+		return
+	}
+	client.Self.Register()
+}
+
+// onLost is called as soon as the connection drops, onRestored once the bot is back in its channel
+func (bot *MumbleBot) setConnectionCallbacks(onLost, onRestored func()) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.onConnectionLost = onLost
+	bot.onReconnect = onRestored
+}
+
+func (bot *MumbleBot) onDisconnect(e *gumble.DisconnectEvent) {
+	switch e.Type {
+	case gumble.DisconnectUser:
+		return
+	case gumble.DisconnectBanned:
+		log.Println("Banned from Mumble server, not reconnecting: ", e.String)
+		return
+	}
+
+	bot.mu.Lock()
+	if bot.reconnecting {
+		bot.mu.Unlock()
+		return
+	}
+	bot.reconnecting = true
+	onLost := bot.onConnectionLost
+	bot.mu.Unlock()
+
+	log.Println("Disconnected from Mumble server, reconnecting.")
+	if onLost != nil {
+		onLost()
+	}
+	go bot.reconnectLoop()
+}
+
+// keeps dialing in the background with the same backoff as a dropped connection, for when Connect failed
+func (bot *MumbleBot) ConnectInBackground() {
+	bot.mu.Lock()
+	if bot.reconnecting {
+		bot.mu.Unlock()
+		return
+	}
+	bot.reconnecting = true
+	bot.mu.Unlock()
+	go bot.reconnectLoop()
+}
+
+func (bot *MumbleBot) reconnectLoop() {
+	delay := reconnectInitialDelay
+	for {
+		time.Sleep(delay)
+		err := bot.dial()
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to reconnect, retrying in %s: %v", min(delay*2, reconnectMaxDelay), err)
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+	log.Println("Reconnected to Mumble server.")
+
+	bot.mu.Lock()
+	bot.reconnecting = false
+	channel := bot.channelName
+	register := bot.registerSelf
+	onRestored := bot.onReconnect
+	bot.mu.Unlock()
+
+	if register {
+		bot.RegisterSelf()
+	}
+	if channel != "" {
+		bot.JoinChannel(channel)
+	}
+	if onRestored != nil {
+		onRestored()
+	}
+}
+
+// everything the player and the bot do is published here
+func (bot *MumbleBot) Events() *EventBus {
+	return bot.events
 }
 
 func (bot *MumbleBot) SetCommandHandler(commandHandler CommandHandler) {
@@ -83,41 +280,250 @@ func (bot *MumbleBot) onTextMessage(e *gumble.TextMessageEvent) {
 	if ch == nil {
 		return
 	}
+	// sent straight to the bot rather than to a channel
+	private := len(e.Channels) == 0 && len(e.Trees) == 0
 	if bot.commandHandler == nil {
-		ch.Send("No command handler has been registered yet.", false)
+		if private {
+			e.Sender.Send("No command handler has been registered yet.")
+		} else {
+			ch.Send("No command handler has been registered yet.", false)
+		}
+		return
 	}
-	message := bot.commandHandler.HandleCommand(e.Message)
-	if message != nil {
-		ch.Send(*message, false)
+	sender := bot.senderFromUser(e.Sender)
+	sender.Private = private
+	reply := bot.commandHandler.HandleCommand(sender, e.Message)
+	if reply == nil {
+		return
+	}
+	if reply.Target == ReplySender {
+		e.Sender.Send(reply.Message)
+	} else {
+		ch.Send(reply.Message, false)
+	}
+}
+
+func (bot *MumbleBot) onACL(e *gumble.ACLEvent) {
+	userGroups := make(map[uint32][]string)
+	for _, group := range e.ACL.Groups {
+		for _, user := range group.UsersAdd {
+			userGroups[user.UserID] = append(userGroups[user.UserID], group.Name)
+		}
+	}
+	bot.mu.Lock()
+	bot.userGroups = userGroups
+	bot.mu.Unlock()
+}
+
+// a refused ACL request is the only sign that group based roles won't work
+func (bot *MumbleBot) onPermissionDenied(e *gumble.PermissionDeniedEvent) {
+	if e.Type == gumble.PermissionDeniedPermission && e.Permission&gumble.PermissionWrite != 0 {
+		channel := ""
+		if e.Channel != nil {
+			channel = e.Channel.Name
+		}
+		log.Printf("Can't read the ACL of channel %q, roles from Mumble groups need the Write ACL permission there.", channel)
+	}
+}
+
+func (bot *MumbleBot) senderFromUser(user *gumble.User) *CommandSender {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	sender := &CommandSender{Name: user.Name, UserID: user.UserID, CertHash: user.Hash}
+	if user.IsRegistered() {
+		sender.Groups = append([]string(nil), bot.userGroups[user.UserID]...)
 	}
+	return sender
+}
+
+// looks for a connected user by name, nil if there's nobody with that name
+func (bot *MumbleBot) FindUser(name string) *CommandSender {
+	bot.mu.Lock()
+	client := bot.client
+	bot.mu.Unlock()
+	if client == nil {
+		return nil
+	}
+	user := client.Users.Find(name)
+	if user == nil {
+		return nil
+	}
+	return bot.senderFromUser(user)
+}
+
+// false while reconnecting
+func (bot *MumbleBot) IsConnected() bool {
+	bot.mu.Lock()
+	client := bot.client
+	bot.mu.Unlock()
+	return client != nil && client.State() == gumble.StateSynced
+}
+
+// everyone in the bot's channel except the bot
+func (bot *MumbleBot) CountChannelUsers() int {
+	bot.mu.Lock()
+	client := bot.client
+	bot.mu.Unlock()
+	if client == nil {
+		return 0
+	}
+	count := 0
+	// gumble changes the user lists from its own goroutine
+	client.Do(func() {
+		if client.Self == nil || client.Self.Channel == nil {
+			return
+		}
+		count = max(len(client.Self.Channel.Users)-1, 0)
+	})
+	return count
+}
+
+// users in the bot's channel who can actually hear it
+func (bot *MumbleBot) CountListeners() int {
+	bot.mu.Lock()
+	client := bot.client
+	bot.mu.Unlock()
+	if client == nil {
+		return 0
+	}
+	count := 0
+	client.Do(func() {
+		if client.Self == nil || client.Self.Channel == nil {
+			return
+		}
+		for _, user := range client.Self.Channel.Users {
+			if user == client.Self || user.Deafened || user.SelfDeafened {
+				continue
+			}
+			count++
+		}
+	})
+	return count
+}
+
+func (bot *MumbleBot) SendChannelMessage(message string) {
+	bot.mu.Lock()
+	client := bot.client
+	bot.mu.Unlock()
+	if client == nil || client.Self == nil || client.Self.Channel == nil {
+		return
+	}
+	client.Self.Channel.Send(message, false)
 }
 
 func (bot *MumbleBot) PlayAudio(data *media.AudioData, onComplete func()) {
+	bot.PlayAudioAt(data, 0, onComplete)
+}
+
+func (bot *MumbleBot) PlayAudioAt(data *media.AudioData, offset time.Duration, onComplete func()) {
+	bot.playAudio(data, offset, false, onComplete)
+}
+
+// false if there's no connection to play to yet
+func (bot *MumbleBot) playAudio(data *media.AudioData, offset time.Duration, paused bool, onComplete func()) bool {
 	bot.mu.Lock()
+	if bot.client == nil {
+		bot.mu.Unlock()
+		return false
+	}
 	if bot.currentStream != nil {
 		bot.mu.Unlock()
-		return
+		return true
 	}
 	bot.currentAudioData = data
-	stream := gumbleffmpeg.New(bot.client, gumbleffmpeg.SourceFile(data.Path))
-	bot.currentStream = stream
+	bot.onComplete = onComplete
+	bot.paused = paused
+	stream := bot.newStream(data, offset)
 	bot.mu.Unlock()
 
-	go func() {
-		err := stream.Play()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Playback error: %v\n", err)
-		}
-		stream.Wait()
-		bot.mu.Lock()
+	go bot.runStream(stream, data, onComplete, paused)
+	return true
+}
+
+// stops the stream without calling its onComplete, returns whether it was paused
+func (bot *MumbleBot) detachAudio() bool {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	paused := bot.paused
+	if bot.currentStream != nil {
+		bot.replacedStreams[bot.currentStream] = struct{}{}
+		bot.currentStream.Stop()
 		bot.currentStream = nil
 		bot.currentAudioData = nil
+		bot.onComplete = nil
+	}
+	bot.paused = false
+	return paused
+}
+
+// must be called with bot.mu held
+func (bot *MumbleBot) newStream(data *media.AudioData, offset time.Duration) *gumbleffmpeg.Stream {
+	stream := gumbleffmpeg.New(bot.client, gumbleffmpeg.SourceFile(data.Path))
+	stream.Offset = offset
+	stream.Volume = bot.streamVolume(data)
+	bot.currentStream = stream
+	bot.currentOffset = offset
+	return stream
+}
+
+func (bot *MumbleBot) runStream(stream *gumbleffmpeg.Stream, data *media.AudioData, onComplete func(), paused bool) {
+	err := stream.Play()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Playback error: %v\n", err)
+		bot.events.Publish(PlaybackErrorEvent{Track: data, Err: err})
+		bot.recordStats(StatsRecorder.PlaybackFailed)
+	} else if paused {
+		stream.Pause()
+	}
+	stream.Wait()
+
+	bot.mu.Lock()
+	// a seek or a disconnect replaced this stream, the track isn't done yet
+	if _, replaced := bot.replacedStreams[stream]; replaced {
+		delete(bot.replacedStreams, stream)
 		bot.mu.Unlock()
+		return
+	}
+	if bot.currentStream == stream {
+		bot.currentStream = nil
+		bot.currentAudioData = nil
+		bot.onComplete = nil
+		bot.paused = false
+	}
+	bot.mu.Unlock()
 
-		if onComplete != nil {
-			onComplete()
-		}
-	}()
+	if onComplete != nil {
+		onComplete()
+	}
+}
+
+// restarts the current track at offset, keeping it paused if it was
+func (bot *MumbleBot) SeekAudio(offset time.Duration) error {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if bot.currentStream == nil || bot.currentAudioData == nil {
+		return errors.New("Not playing anything.")
+	}
+	bot.restartStream(max(offset, 0))
+	return nil
+}
+
+// replaces the playing stream with a new one at the offset, must be called with bot.mu held and a stream playing
+func (bot *MumbleBot) restartStream(offset time.Duration) {
+	old := bot.currentStream
+	bot.replacedStreams[old] = struct{}{}
+	stream := bot.newStream(bot.currentAudioData, offset)
+	old.Stop()
+	go bot.runStream(stream, bot.currentAudioData, bot.onComplete, bot.paused)
+}
+
+func (bot *MumbleBot) GetPosition() (time.Duration, error) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if bot.currentStream == nil {
+		return 0, errors.New("Not playing anything.")
+	}
+	return bot.currentOffset + bot.currentStream.Elapsed(), nil
 }
 
 func (bot *MumbleBot) GetCurrentAudioData() *media.AudioData {
@@ -133,6 +539,8 @@ func (bot *MumbleBot) StopAudio() {
 		bot.currentStream.Stop()
 		bot.currentStream = nil
 		bot.currentAudioData = nil
+		bot.onComplete = nil
+		bot.paused = false
 	}
 }
 
@@ -163,3 +571,66 @@ func (bot *MumbleBot) IsPaused() bool {
 	defer bot.mu.Unlock()
 	return bot.paused
 }
+
+// percent is clamped to 0-100, also applies to the stream that's playing right now
+func (bot *MumbleBot) SetVolume(percent int) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.volume = float32(min(max(percent, 0), 100)) / 100
+	// gumbleffmpeg reads Volume while it plays, so the stream is restarted with the new one instead
+	if bot.currentStream != nil && bot.currentStream.Volume != bot.streamVolume(bot.currentAudioData) {
+		bot.restartStream(bot.currentOffset + bot.currentStream.Elapsed())
+	}
+}
+
+func (bot *MumbleBot) GetVolume() int {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return int(math.Round(float64(bot.volume) * 100))
+}
+
+func (bot *MumbleBot) SetNormalizeMode(mode NormalizeMode) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.normalizeMode = mode
+	// same as SetVolume, the playing stream can't be changed in place
+	if bot.currentStream != nil && bot.currentStream.Volume != bot.streamVolume(bot.currentAudioData) {
+		bot.restartStream(bot.currentOffset + bot.currentStream.Elapsed())
+	}
+}
+
+func (bot *MumbleBot) GetNormalizeMode() NormalizeMode {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.normalizeMode
+}
+
+// volume with ReplayGain applied, must be called with bot.mu held
+func (bot *MumbleBot) streamVolume(data *media.AudioData) float32 {
+	if data == nil || bot.normalizeMode == NormalizeOff {
+		return bot.volume
+	}
+	// tracks without gain get the same headroom so they don't jump out
+	gain := normalizeHeadroom
+	if data.TrackGain != nil {
+		gain += *data.TrackGain
+	}
+	if bot.normalizeMode == NormalizeAlbum && data.AlbumGain != nil {
+		gain = normalizeHeadroom + *data.AlbumGain
+	}
+	// gumbleffmpeg doesn't clip, anything above 1 wraps around
+	return float32(min(float64(bot.volume)*math.Pow(10, gain/20), 1))
+}
+
+func NormalizeModeToString(mode NormalizeMode) string {
+	switch mode {
+	case NormalizeOff:
+		return "Off"
+	case NormalizeTrack:
+		return "Track"
+	case NormalizeAlbum:
+		return "Album"
+	default:
+		return ""
+	}
+}
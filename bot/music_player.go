@@ -2,10 +2,15 @@ package bot
 
 import (
 	"errors"
+	"log"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/EricZhang456/mumble-music-bot/media"
 	"github.com/EricZhang456/mumble-music-bot/utils"
+	"gorm.io/gorm"
 )
 
 type PlaybackMode int
@@ -25,32 +30,97 @@ const (
 	OutOfRange
 )
 
+// a track in the playlist, its ID stays the same while it's moved around
+type QueuedTrack struct {
+	ID    int
+	Track *media.AudioData
+}
+
 type MusicPlayer struct {
-	bot          *MumbleBot
-	playlist     []*media.AudioData
-	mode         PlaybackMode
-	currentIndex int
-	mu           sync.Mutex
-	stopped      bool
+	bot           *MumbleBot
+	db            *gorm.DB
+	playlist      []*media.AudioData
+	entryIDs      map[*media.AudioData]int
+	nextEntryID   int
+	mode          PlaybackMode
+	currentIndex  int
+	mu            sync.Mutex
+	stopped       bool
+	startOffset   time.Duration
+	startPaused   bool
+	resumeOffset  time.Duration
+	resumePending bool
+	suspended     bool
+	skipVotes     map[string]struct{}
+	skipping      bool
+	jumpPending   bool
+	jumpIndex     int
+	queueDirty    bool
+	stateDirty    bool
+	saveSignal    chan struct{}
+	saveDone      chan struct{}
+	saveMu        sync.Mutex
+	closeOnce     sync.Once
 }
 
-func CreateMusicPlayer(bot *MumbleBot) *MusicPlayer {
-	musicPlayer := &MusicPlayer{bot: bot}
-	musicPlayer.SetMode(Single)
+func CreateMusicPlayer(bot *MumbleBot, db *gorm.DB) *MusicPlayer {
+	musicPlayer := &MusicPlayer{bot: bot, db: db, entryIDs: make(map[*media.AudioData]int)}
+	musicPlayer.mode = Single
 	musicPlayer.stopped = true
+	musicPlayer.saveSignal = make(chan struct{}, 1)
+	musicPlayer.saveDone = make(chan struct{})
+	if err := musicPlayer.restoreState(); err != nil {
+		log.Println("Cannot restore playlist from DB: ", err)
+	}
+	if db != nil {
+		go musicPlayer.runStateSaver()
+	}
+	bot.setConnectionCallbacks(musicPlayer.suspendPlayback, musicPlayer.resumeAfterReconnect)
 	return musicPlayer
 }
 
 func (mp *MusicPlayer) AddToPlaylist(track media.AudioData) {
-	mp.mu.Lock()
-	mp.playlist = append(mp.playlist, &track)
-	mp.mu.Unlock()
+	mp.AddAllToPlaylist([]media.AudioData{track})
 }
 
 func (mp *MusicPlayer) AddAllToPlaylist(tracks []media.AudioData) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.insertIntoPlaylist(len(mp.playlist), tracks)
+}
+
+// puts the tracks in the playlist starting at the given position, returns the ID of the first one, the rest follow in order
+func (mp *MusicPlayer) InsertIntoPlaylist(at int, tracks []media.AudioData) (int, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if at < 0 || at > len(mp.playlist) {
+		return 0, errors.New("Playlist index out of range.")
+	}
+	return mp.insertIntoPlaylist(at, tracks), nil
+}
+
+// must be called with mp.mu held
+func (mp *MusicPlayer) insertIntoPlaylist(at int, tracks []media.AudioData) int {
+	entries := make([]*media.AudioData, 0, len(tracks))
 	for _, track := range tracks {
-		mp.AddToPlaylist(track)
+		entries = append(entries, mp.newEntry(track))
 	}
+	// what's playing keeps playing
+	if at <= mp.currentIndex && mp.currentIndex < len(mp.playlist) {
+		mp.currentIndex += len(entries)
+	}
+	mp.playlist = slices.Insert(mp.playlist, at, entries...)
+	mp.saveQueue()
+	mp.updateNowPlaying()
+	mp.publishQueueChanged()
+	return mp.nextEntryID - len(entries) + 1
+}
+
+// must be called with mp.mu held
+func (mp *MusicPlayer) newEntry(track media.AudioData) *media.AudioData {
+	mp.nextEntryID++
+	mp.entryIDs[&track] = mp.nextEntryID
+	return &track
 }
 
 func (mp *MusicPlayer) GetMode() PlaybackMode {
@@ -63,6 +133,9 @@ func (mp *MusicPlayer) SetMode(mode PlaybackMode) {
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
 	mp.mode = mode
+	defer mp.updateNowPlaying()
+	defer mp.saveQueue()
+	mp.bot.events.Publish(ModeChangedEvent{Mode: mode})
 	if mode == Shuffle || mode == ShuffleRepeat {
 		if len(mp.playlist) == 0 {
 			return
@@ -75,6 +148,7 @@ func (mp *MusicPlayer) SetMode(mode PlaybackMode) {
 				break
 			}
 		}
+		mp.publishQueueChanged()
 	}
 }
 
@@ -91,6 +165,8 @@ func (mp *MusicPlayer) StartPlaylist() {
 		switch mp.mode {
 		case ShuffleRepeat:
 			utils.ShuffleList(mp.playlist)
+			mp.saveQueue()
+			mp.publishQueueChanged()
 			fallthrough
 		case Repeat:
 			mp.currentIndex = 0
@@ -111,6 +187,7 @@ func (mp *MusicPlayer) Skip() error {
 		mp.mu.Unlock()
 		return errors.New("Not playing anything.")
 	}
+	mp.skipping = true
 
 	mp.mu.Unlock()
 	mp.bot.StopAudio()
@@ -118,25 +195,95 @@ func (mp *MusicPlayer) Skip() error {
 	return nil
 }
 
+// plays a track in the playlist right away, starting playback if it's stopped
+func (mp *MusicPlayer) PlayIndex(index int) error {
+	mp.mu.Lock()
+	if index < 0 || index >= len(mp.playlist) {
+		mp.mu.Unlock()
+		return errors.New("Playlist index out of range.")
+	}
+	if mp.stopped {
+		mp.currentIndex = index
+		mp.mu.Unlock()
+		mp.StartPlaylist()
+		return nil
+	}
+	// the completion callback picks the track up once the current one is stopped
+	mp.jumpPending = true
+	mp.jumpIndex = index
+	mp.skipping = true
+
+	mp.mu.Unlock()
+	mp.bot.StopAudio()
+
+	return nil
+}
+
+// counts a vote against the current track and skips it once there are enough, returns the vote count
+func (mp *MusicPlayer) VoteSkip(voter string, votesNeeded int) (int, bool, error) {
+	mp.mu.Lock()
+	if mp.stopped {
+		mp.mu.Unlock()
+		return 0, false, errors.New("Not playing anything.")
+	}
+	if mp.skipVotes == nil {
+		mp.skipVotes = make(map[string]struct{})
+	}
+	mp.skipVotes[voter] = struct{}{}
+	votes := len(mp.skipVotes)
+	mp.mu.Unlock()
+
+	if votes < votesNeeded {
+		return votes, false, nil
+	}
+	return votes, true, mp.Skip()
+}
+
 func (mp *MusicPlayer) RemoveFromPlaylist(index int) (*media.AudioData, RemoveResult) {
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
-
 	if index < 0 || index >= len(mp.playlist) {
 		return nil, OutOfRange
 	}
+	ret := mp.playlist[index]
+	return ret, mp.removeRange(index, index+1)
+}
 
-	if index == mp.currentIndex && !mp.stopped {
-		return nil, Playing
+// removes a single queued track by its queue ID, other copies of the same track stay
+func (mp *MusicPlayer) RemoveQueuedTrack(id int) (*media.AudioData, RemoveResult) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for index, track := range mp.playlist {
+		if mp.entryIDs[track] == id {
+			return track, mp.removeRange(index, index+1)
+		}
 	}
+	return nil, OutOfRange
+}
 
-	ret := mp.playlist[index]
+// removes the tracks from start up to end, or none of them if the playing track is among them
+func (mp *MusicPlayer) RemoveRangeFromPlaylist(start, end int) RemoveResult {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.removeRange(start, end)
+}
 
-	if index < mp.currentIndex {
-		mp.currentIndex--
+// nothing is removed unless the whole range can be, must be called with mp.mu held
+func (mp *MusicPlayer) removeRange(start, end int) RemoveResult {
+	if start < 0 || start >= end || end > len(mp.playlist) {
+		return OutOfRange
+	}
+	if !mp.stopped && mp.currentIndex >= start && mp.currentIndex < end {
+		return Playing
 	}
 
-	mp.playlist = utils.RemoveByIndex(mp.playlist, index)
+	for _, track := range mp.playlist[start:end] {
+		delete(mp.entryIDs, track)
+	}
+	if mp.currentIndex >= end {
+		mp.currentIndex -= end - start
+	}
+	mp.playlist = slices.Delete(mp.playlist, start, end)
 
 	if len(mp.playlist) == 0 {
 		mp.currentIndex = 0
@@ -144,7 +291,44 @@ func (mp *MusicPlayer) RemoveFromPlaylist(index int) (*media.AudioData, RemoveRe
 	} else if mp.currentIndex >= len(mp.playlist) {
 		mp.currentIndex = len(mp.playlist) - 1
 	}
-	return ret, Success
+	mp.saveQueue()
+	mp.updateNowPlaying()
+	mp.publishQueueChanged()
+	return Success
+}
+
+// moves a track to another place in the playlist, what's playing keeps playing
+func (mp *MusicPlayer) MoveInPlaylist(from, to int) error {
+	return mp.MoveRangeInPlaylist(from, from+1, to)
+}
+
+// moves the tracks from start up to end so they begin at the given position, in the same order
+func (mp *MusicPlayer) MoveRangeInPlaylist(start, end, to int) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if start < 0 || start >= end || end > len(mp.playlist) || to < 0 || to+end-start > len(mp.playlist) {
+		return errors.New("Playlist index out of range.")
+	}
+	if start == to {
+		return nil
+	}
+	var current *media.AudioData
+	if mp.currentIndex < len(mp.playlist) {
+		current = mp.playlist[mp.currentIndex]
+	}
+	moved := slices.Clone(mp.playlist[start:end])
+	mp.playlist = slices.Delete(mp.playlist, start, end)
+	mp.playlist = slices.Insert(mp.playlist, to, moved...)
+	for index, t := range mp.playlist {
+		if t == current {
+			mp.currentIndex = index
+			break
+		}
+	}
+	mp.saveQueue()
+	mp.updateNowPlaying()
+	mp.publishQueueChanged()
+	return nil
 }
 
 func (mp *MusicPlayer) playNext() {
@@ -155,19 +339,96 @@ func (mp *MusicPlayer) playNext() {
 		return
 	}
 	track := mp.playlist[mp.currentIndex]
+	offset := mp.startOffset
+	paused := mp.startPaused
+	mp.startOffset = 0
+	mp.startPaused = false
+	mp.skipVotes = nil
+	mp.skipping = false
+	mp.jumpPending = false
+	index := mp.currentIndex
+	mp.savePlaybackState()
 	mp.mu.Unlock()
 
-	mp.bot.PlayAudio(track, func() {
+	started := mp.bot.playAudio(track, offset, paused, func() {
 		mp.mu.Lock()
 		if mp.stopped {
 			mp.mu.Unlock()
 			return
 		}
-		mp.currentIndex++
+		if mp.skipping {
+			mp.bot.events.Publish(TrackSkippedEvent{Track: track})
+			mp.bot.recordStats(StatsRecorder.TrackSkipped)
+		} else {
+			mp.bot.events.Publish(TrackFinishedEvent{Track: track})
+		}
+		mp.skipping = false
+		if mp.jumpPending {
+			mp.currentIndex = mp.jumpIndex
+			mp.jumpPending = false
+		} else {
+			mp.currentIndex++
+		}
+		mp.savePlaybackState()
 		mp.mu.Unlock()
 
 		mp.StartPlaylist()
 	})
+	if !started {
+		// still waiting for the first connection, resumeAfterReconnect picks this up
+		mp.mu.Lock()
+		mp.startOffset = offset
+		mp.startPaused = paused
+		mp.suspended = true
+		mp.mu.Unlock()
+		return
+	}
+
+	mp.mu.Lock()
+	mp.updateNowPlaying()
+	mp.mu.Unlock()
+	mp.bot.events.Publish(TrackStartedEvent{Track: track, Index: index, Offset: offset})
+	if offset == 0 {
+		mp.bot.recordStats(StatsRecorder.TrackPlayed)
+	}
+}
+
+// the connection dropped, remember where we were without moving on to the next track
+func (mp *MusicPlayer) suspendPlayback() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.stopped {
+		return
+	}
+	position, _ := mp.bot.GetPosition()
+	mp.savePlaybackState()
+	mp.startPaused = mp.bot.detachAudio()
+	mp.startOffset = position
+	mp.suspended = true
+}
+
+func (mp *MusicPlayer) resumeAfterReconnect() {
+	mp.mu.Lock()
+	if !mp.suspended {
+		mp.mu.Unlock()
+		return
+	}
+	mp.suspended = false
+	if mp.stopped {
+		mp.mu.Unlock()
+		return
+	}
+	mp.mu.Unlock()
+	mp.StartPlaylist()
+}
+
+func (mp *MusicPlayer) Events() *EventBus {
+	return mp.bot.events
+}
+
+// must be called with mp.mu held
+func (mp *MusicPlayer) publishQueueChanged() {
+	mp.bot.events.Publish(QueueChangedEvent{Length: len(mp.playlist)})
 }
 
 func (mp *MusicPlayer) GetCurrentTrack() *media.AudioData {
@@ -179,24 +440,69 @@ func (mp *MusicPlayer) GetCurrentTrack() *media.AudioData {
 	return mp.playlist[mp.currentIndex]
 }
 
+// -1 when nothing is playing
+func (mp *MusicPlayer) GetCurrentIndex() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.stopped || len(mp.playlist) == 0 {
+		return -1
+	}
+	return mp.currentIndex
+}
+
 func (mp *MusicPlayer) GetPlaylist() []*media.AudioData {
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
 	return append([]*media.AudioData(nil), mp.playlist...)
 }
 
+func (mp *MusicPlayer) GetQueuedTracks() []QueuedTrack {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	queued := make([]QueuedTrack, 0, len(mp.playlist))
+	for _, track := range mp.playlist {
+		queued = append(queued, QueuedTrack{ID: mp.entryIDs[track], Track: track})
+	}
+	return queued
+}
+
+// the position of the track with the ID, -1 if it's not in the playlist anymore
+func (mp *MusicPlayer) FindQueuedTrack(id int) int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for index, track := range mp.playlist {
+		if mp.entryIDs[track] == id {
+			return index
+		}
+	}
+	return -1
+}
+
 func (mp *MusicPlayer) StopPlaylist() {
 	mp.mu.Lock()
 	mp.currentIndex = 0
 	mp.stopped = true
+	mp.startOffset = 0
+	mp.startPaused = false
+	mp.suspended = false
+	mp.savePlaybackState()
 	mp.mu.Unlock()
 	mp.bot.StopAudio()
+
+	mp.mu.Lock()
+	mp.updateNowPlaying()
+	mp.mu.Unlock()
+	mp.bot.events.Publish(PlaybackStoppedEvent{})
 }
 
 func (mp *MusicPlayer) ClearPlaylist() {
 	mp.StopPlaylist()
 	mp.mu.Lock()
 	mp.playlist = nil
+	clear(mp.entryIDs)
+	mp.saveQueue()
+	mp.updateNowPlaying()
+	mp.publishQueueChanged()
 	mp.mu.Unlock()
 }
 
@@ -206,7 +512,14 @@ func (mp *MusicPlayer) Pause() error {
 	if mp.stopped {
 		return errors.New("Playback is stopped.")
 	}
-	return mp.bot.PauseStream()
+	if err := mp.bot.PauseStream(); err != nil {
+		return err
+	}
+	mp.savePlaybackState()
+	mp.updateNowPlaying()
+	position, _ := mp.bot.GetPosition()
+	mp.bot.events.Publish(PausedEvent{Track: mp.playlist[mp.currentIndex], Position: position})
+	return nil
 }
 
 func (mp *MusicPlayer) Unpause() error {
@@ -215,7 +528,52 @@ func (mp *MusicPlayer) Unpause() error {
 	if mp.stopped {
 		return errors.New("Playback is stopped.")
 	}
-	return mp.bot.UnpauseStream()
+	if err := mp.bot.UnpauseStream(); err != nil {
+		return err
+	}
+	mp.updateNowPlaying()
+	position, _ := mp.bot.GetPosition()
+	mp.bot.events.Publish(ResumedEvent{Track: mp.playlist[mp.currentIndex], Position: position})
+	return nil
+}
+
+func (mp *MusicPlayer) Seek(offset time.Duration) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.stopped {
+		return errors.New("Playback is stopped.")
+	}
+	if err := mp.bot.SeekAudio(offset); err != nil {
+		return err
+	}
+	mp.savePlaybackState()
+	mp.updateNowPlaying()
+	return nil
+}
+
+func (mp *MusicPlayer) GetPosition() (time.Duration, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.stopped {
+		return 0, errors.New("Playback is stopped.")
+	}
+	return mp.bot.GetPosition()
+}
+
+func (mp *MusicPlayer) SetVolume(percent int) {
+	mp.bot.SetVolume(percent)
+}
+
+func (mp *MusicPlayer) GetVolume() int {
+	return mp.bot.GetVolume()
+}
+
+func (mp *MusicPlayer) SetNormalizeMode(mode NormalizeMode) {
+	mp.bot.SetNormalizeMode(mode)
+}
+
+func (mp *MusicPlayer) GetNormalizeMode() NormalizeMode {
+	return mp.bot.GetNormalizeMode()
 }
 
 func (mp *MusicPlayer) IsPaused() bool {
@@ -227,6 +585,20 @@ func (mp *MusicPlayer) IsPaused() bool {
 	return mp.bot.IsPaused()
 }
 
+func ParsePlaybackMode(modeStr string) (PlaybackMode, bool) {
+	switch strings.ToLower(modeStr) {
+	case "single":
+		return Single, true
+	case "shuffle":
+		return Shuffle, true
+	case "repeat":
+		return Repeat, true
+	case "shufflerepeat":
+		return ShuffleRepeat, true
+	}
+	return Single, false
+}
+
 func PlaybackModeToString(mode PlaybackMode) string {
 	switch mode {
 	case Single:
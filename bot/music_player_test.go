@@ -0,0 +1,174 @@
+package bot_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/internal/testutil"
+	"github.com/EricZhang456/mumble-music-bot/media"
+)
+
+var testTracks = []media.AudioData{
+	{Path: "/music/a.flac", Title: "A"},
+	{Path: "/music/b.flac", Title: "B"},
+	{Path: "/music/c.flac", Title: "C"},
+	{Path: "/music/d.flac", Title: "D"},
+	{Path: "/music/e.flac", Title: "E"},
+}
+
+// starts "playing" the track at index, the test bot never connects so it just waits there
+func startAt(t *testing.T, player *testutil.Player, index int) {
+	t.Helper()
+	if err := player.PlayIndex(index); err != nil {
+		t.Fatal(err)
+	}
+	player.WaitUntilSuspended(t)
+}
+
+func titles(mp *bot.MusicPlayer) string {
+	var s string
+	for _, track := range mp.GetPlaylist() {
+		s += track.Title
+	}
+	return s
+}
+
+func TestVoteSkip(t *testing.T) {
+	player := testutil.NewPlayer(t, testTracks...)
+	if _, _, err := player.VoteSkip("alice", 2); err == nil {
+		t.Error("expected an error when nothing is playing")
+	}
+	player.AddAllToPlaylist(player.Tracks)
+	startAt(t, player, 0)
+
+	for _, tc := range []struct {
+		voter   string
+		votes   int
+		skipped bool
+	}{
+		{"alice", 1, false},
+		{"alice", 1, false},
+		{"bob", 2, false},
+		{"carol", 3, true},
+	} {
+		votes, skipped, err := player.VoteSkip(tc.voter, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if votes != tc.votes || skipped != tc.skipped {
+			t.Errorf("%s: got %d votes skipped=%t, want %d skipped=%t", tc.voter, votes, skipped, tc.votes, tc.skipped)
+		}
+	}
+
+	// votes are for one track, the next one starts over
+	player.PlayNext()
+	if votes, _, _ := player.VoteSkip("alice", 3); votes != 1 {
+		t.Errorf("expected the votes to reset, got %d", votes)
+	}
+}
+
+func TestInsertIntoPlaylist(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		playing   int // -1 for stopped
+		at        int
+		want      string
+		wantIndex int
+		wantErr   bool
+	}{
+		{"at the end", 1, 3, "ABCDE", 1, false},
+		{"after the current track", 1, 2, "ABDEC", 1, false},
+		{"before the current track", 2, 1, "ADEBC", 4, false},
+		{"at the current track", 1, 1, "ADEBC", 3, false},
+		{"at the start", 2, 0, "DEABC", 4, false},
+		{"while stopped", -1, 0, "DEABC", -1, false},
+		{"out of range", 1, 4, "ABC", 1, true},
+		{"negative", 1, -1, "ABC", 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			player := testutil.NewPlayer(t, testTracks...)
+			player.AddAllToPlaylist(player.Tracks[:3])
+			if tc.playing >= 0 {
+				startAt(t, player, tc.playing)
+			}
+			before := player.GetQueuedTracks()
+
+			id, err := player.InsertIntoPlaylist(tc.at, player.Tracks[3:])
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := titles(player.MusicPlayer); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+			if got := player.GetCurrentIndex(); got != tc.wantIndex {
+				t.Errorf("current index %d, want %d", got, tc.wantIndex)
+			}
+			if tc.wantErr {
+				return
+			}
+			// queue IDs keep counting up and the ones already there don't change
+			if id != 4 || player.FindQueuedTrack(4) != tc.at || player.FindQueuedTrack(5) != tc.at+1 {
+				t.Errorf("unexpected queue IDs: first %d, %v", id, player.GetQueuedTracks())
+			}
+			for _, queued := range before {
+				if index := player.FindQueuedTrack(queued.ID); player.GetQueuedTracks()[index].Track.Title != queued.Track.Title {
+					t.Errorf("queue ID %d moved to %s", queued.ID, player.GetQueuedTracks()[index].Track.Title)
+				}
+			}
+		})
+	}
+}
+
+func TestMoveRangeInPlaylist(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		start, end int
+		to         int
+		want       string
+		wantIndex  int // C is playing
+		wantErr    bool
+	}{
+		{"one forward", 0, 1, 2, "BCADE", 1, false},
+		{"one back", 4, 5, 0, "EABCD", 3, false},
+		{"range forward", 0, 2, 3, "CDEAB", 0, false},
+		{"range back", 3, 5, 1, "ADEBC", 4, false},
+		{"the current track", 2, 3, 4, "ABDEC", 4, false},
+		{"range with the current track", 1, 3, 0, "BCADE", 1, false},
+		{"in place", 1, 3, 1, "ABCDE", 2, false},
+		{"past the end", 3, 5, 4, "ABCDE", 2, true},
+		{"empty range", 2, 2, 0, "ABCDE", 2, true},
+		{"end out of range", 4, 6, 0, "ABCDE", 2, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			player := testutil.NewPlayer(t, testTracks...)
+			player.AddAllToPlaylist(player.Tracks)
+			startAt(t, player, 2)
+			ids := map[string]int{}
+			for _, queued := range player.GetQueuedTracks() {
+				ids[queued.Track.Title] = queued.ID
+			}
+
+			err := player.MoveRangeInPlaylist(tc.start, tc.end, tc.to)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := titles(player.MusicPlayer); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+			if got := player.GetCurrentIndex(); got != tc.wantIndex {
+				t.Errorf("current index %d, want %d", got, tc.wantIndex)
+			}
+			if player.GetCurrentTrack().Title != "C" {
+				t.Errorf("expected C to keep playing, got %s", player.GetCurrentTrack().Title)
+			}
+			after := map[string]int{}
+			for _, queued := range player.GetQueuedTracks() {
+				after[queued.Track.Title] = queued.ID
+			}
+			if !reflect.DeepEqual(ids, after) {
+				t.Errorf("queue IDs changed: %v, was %v", after, ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	"github.com/EricZhang456/mumble-music-bot/media"
+	"github.com/EricZhang456/mumble-music-bot/utils"
+)
+
+// must be called with mp.mu held
+func (mp *MusicPlayer) updateNowPlaying() {
+	if mp.stopped || len(mp.playlist) == 0 {
+		mp.bot.SetNowPlaying("<b>Not playing anything.</b>"+mp.queueSummary(), nil)
+		return
+	}
+	track := mp.playlist[mp.currentIndex]
+	var sb strings.Builder
+	sb.WriteString("<b>Now playing:</b> " + html.EscapeString(track.Title))
+	if track.Artists != nil {
+		sb.WriteString("<br><b>Artists:</b> " + html.EscapeString(*track.Artists))
+	}
+	if track.Album != nil {
+		sb.WriteString("<br><b>Album:</b> " + html.EscapeString(*track.Album))
+	}
+	position, err := mp.bot.GetPosition()
+	if err == nil {
+		sb.WriteString("<br>" + utils.FormatDuration(position))
+		if track.Duration != nil {
+			sb.WriteString(" / " + utils.FormatDuration(*track.Duration))
+		}
+	}
+	if mp.bot.IsPaused() {
+		sb.WriteString(" <i>(Paused)</i>")
+	}
+	sb.WriteString(mp.queueSummary())
+	snapshot := *track
+	mp.bot.SetNowPlaying(sb.String(), &snapshot)
+}
+
+// must be called with mp.mu held
+func (mp *MusicPlayer) queueSummary() string {
+	summary := "<br><b>Mode:</b> " + PlaybackModeToString(mp.mode)
+	if len(mp.playlist) == 0 {
+		return summary + "<br><b>Playlist:</b> empty"
+	}
+	if mp.stopped {
+		return summary + fmt.Sprintf("<br><b>Playlist:</b> %d tracks", len(mp.playlist))
+	}
+	return summary + fmt.Sprintf("<br><b>Playlist:</b> track %d of %d", mp.currentIndex+1, len(mp.playlist))
+}
+
+type nowPlayingUpdate struct {
+	comment string
+	track   *media.AudioData
+}
+
+// sets the bot's comment, and its avatar to the track's cover art when the track changes
+// it's sent from another goroutine so callers can hold their locks, only the latest update is sent
+func (bot *MumbleBot) SetNowPlaying(comment string, data *media.AudioData) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.pendingNowPlaying = &nowPlayingUpdate{comment: comment, track: data}
+	if !bot.sendingNowPlaying {
+		bot.sendingNowPlaying = true
+		go bot.sendNowPlaying()
+	}
+}
+
+func (bot *MumbleBot) sendNowPlaying() {
+	for {
+		bot.mu.Lock()
+		update := bot.pendingNowPlaying
+		bot.pendingNowPlaying = nil
+		if update == nil {
+			bot.sendingNowPlaying = false
+			bot.mu.Unlock()
+			return
+		}
+		client := bot.client
+		texturePath := ""
+		if update.track != nil {
+			texturePath = update.track.Path
+		}
+		textureChanged := !bot.textureSet || texturePath != bot.texturePath
+		if client != nil {
+			bot.texturePath = texturePath
+			bot.textureSet = true
+		}
+		bot.mu.Unlock()
+		if client == nil {
+			continue
+		}
+
+		var texture []byte
+		if textureChanged {
+			texture = bot.CoverThumbnail(update.track)
+		}
+		client.Do(func() {
+			if client.Self == nil {
+				return
+			}
+			client.Self.SetComment(update.comment)
+			if textureChanged {
+				client.Self.SetTexture(texture)
+			}
+		})
+	}
+}
+
+func (bot *MumbleBot) SetCoverCache(cache *media.CoverCache) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.coverCache = cache
+}
+
+// the cached thumbnail of the track's cover art, nil if there's no cache or no art
+func (bot *MumbleBot) CoverThumbnail(data *media.AudioData) []byte {
+	bot.mu.Lock()
+	cache := bot.coverCache
+	bot.mu.Unlock()
+	if cache == nil || data == nil {
+		return nil
+	}
+	thumbnail, err := cache.Read(data)
+	if err != nil {
+		log.Println("Failed to read cover art thumbnail: ", err)
+		return nil
+	}
+	return thumbnail
+}
@@ -0,0 +1,131 @@
+package bot
+
+import (
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type Role int
+
+const (
+	RoleListener Role = iota
+	RoleDJ
+	RoleAdmin
+)
+
+// who sent a command, registered users have a non-zero UserID
+type CommandSender struct {
+	Name     string
+	UserID   uint32
+	CertHash string
+	Groups   []string
+	Private  bool
+}
+
+func (s *CommandSender) IsRegistered() bool {
+	return s.UserID > 0
+}
+
+// a role granted to a user, matched by certificate hash first and registered user ID second
+type UserRole struct {
+	ID       uint `gorm:"primaryKey"`
+	Name     string
+	CertHash string `gorm:"index"`
+	UserID   uint32 `gorm:"index"`
+	Role     Role
+}
+
+// members of these Mumble groups get the role without being granted it
+var groupRoles = map[string]Role{
+	"admin": RoleAdmin,
+}
+
+func RoleToString(role Role) string {
+	switch role {
+	case RoleListener:
+		return "Listener"
+	case RoleDJ:
+		return "DJ"
+	case RoleAdmin:
+		return "Admin"
+	default:
+		return ""
+	}
+}
+
+func ParseRole(roleStr string) (Role, bool) {
+	switch strings.ToLower(roleStr) {
+	case "listener":
+		return RoleListener, true
+	case "dj":
+		return RoleDJ, true
+	case "admin":
+		return RoleAdmin, true
+	}
+	return RoleListener, false
+}
+
+func findUserRole(db *gorm.DB, sender *CommandSender) (*UserRole, error) {
+	var roles []UserRole
+	if sender.CertHash != "" {
+		if err := db.Where("cert_hash = ?", sender.CertHash).Limit(1).Find(&roles).Error; err != nil {
+			return nil, err
+		}
+	}
+	if len(roles) == 0 && sender.IsRegistered() {
+		if err := db.Where("user_id = ?", sender.UserID).Limit(1).Find(&roles).Error; err != nil {
+			return nil, err
+		}
+	}
+	if len(roles) == 0 {
+		return nil, nil
+	}
+	return &roles[0], nil
+}
+
+// the highest of the default role, any granted role and any role from Mumble groups
+func (com *MusicPlayerCommandHandler) resolveRole(sender *CommandSender) Role {
+	if sender == nil {
+		return com.defaultRole
+	}
+	if sender.CertHash != "" && slices.Contains(com.adminCertHashes, strings.ToLower(sender.CertHash)) {
+		return RoleAdmin
+	}
+	// a granted role is used as is, so it can also take permissions away
+	granted, err := findUserRole(com.db, sender)
+	if err == nil && granted != nil {
+		return granted.Role
+	}
+	role := com.defaultRole
+	for _, group := range sender.Groups {
+		if groupRole, ok := groupRoles[strings.ToLower(group)]; ok {
+			role = max(role, groupRole)
+		}
+	}
+	return role
+}
+
+func grantRole(db *gorm.DB, user *CommandSender, role Role) error {
+	existing, err := findUserRole(db, user)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		existing = &UserRole{}
+	}
+	existing.Name = user.Name
+	existing.CertHash = user.CertHash
+	existing.UserID = user.UserID
+	existing.Role = role
+	return db.Save(existing).Error
+}
+
+func revokeRole(db *gorm.DB, user *CommandSender) (bool, error) {
+	existing, err := findUserRole(db, user)
+	if err != nil || existing == nil {
+		return false, err
+	}
+	return true, db.Delete(existing).Error
+}
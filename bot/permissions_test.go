@@ -0,0 +1,53 @@
+package bot_test
+
+import (
+	"testing"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/internal/testutil"
+)
+
+func TestResolveRole(t *testing.T) {
+	player := testutil.NewPlayer(t)
+	handler := bot.CreateCommandHandler("!", player.MusicPlayer, player.DB)
+	handler.SetDefaultRole(bot.RoleDJ)
+	handler.SetAdminCertHashes([]string{" ADMINCERT "})
+	grants := []bot.UserRole{
+		{Name: "demoted", CertHash: "demotedcert", Role: bot.RoleListener},
+		{Name: "registered", UserID: 7, Role: bot.RoleListener},
+		{Name: "promoted", CertHash: "promotedcert", Role: bot.RoleAdmin},
+		{Name: "granted admin", CertHash: "admincert", Role: bot.RoleListener},
+	}
+	if err := player.DB.Create(&grants).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		sender *bot.CommandSender
+		want   bot.Role
+	}{
+		{"no sender", nil, bot.RoleDJ},
+		{"default", &bot.CommandSender{Name: "nobody", CertHash: "othercert"}, bot.RoleDJ},
+		{"admin cert", &bot.CommandSender{Name: "admin", CertHash: "AdminCert"}, bot.RoleAdmin},
+		{"admin cert beats a grant", &bot.CommandSender{Name: "granted admin", CertHash: "admincert"}, bot.RoleAdmin},
+		{"granted by cert", &bot.CommandSender{Name: "promoted", CertHash: "promotedcert"}, bot.RoleAdmin},
+		{"grant below default", &bot.CommandSender{Name: "demoted", CertHash: "demotedcert"}, bot.RoleListener},
+		{"grant beats groups", &bot.CommandSender{Name: "demoted", CertHash: "demotedcert", UserID: 3, Groups: []string{"admin"}}, bot.RoleListener},
+		{"granted by user ID", &bot.CommandSender{Name: "registered", CertHash: "newcert", UserID: 7}, bot.RoleListener},
+		{"group", &bot.CommandSender{Name: "member", UserID: 8, Groups: []string{"Admin"}}, bot.RoleAdmin},
+		{"unknown group", &bot.CommandSender{Name: "member", UserID: 9, Groups: []string{"friends"}}, bot.RoleDJ},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := handler.ResolveRole(tc.sender); got != tc.want {
+				t.Errorf("got %s, want %s", bot.RoleToString(got), bot.RoleToString(tc.want))
+			}
+		})
+	}
+
+	// groups only ever raise the default
+	handler.SetDefaultRole(bot.RoleAdmin)
+	if got := handler.ResolveRole(&bot.CommandSender{Name: "member", UserID: 9, Groups: []string{"friends"}}); got != bot.RoleAdmin {
+		t.Errorf("got %s, want Admin", bot.RoleToString(got))
+	}
+}
@@ -0,0 +1,235 @@
+package bot
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/EricZhang456/mumble-music-bot/media"
+	"gorm.io/gorm"
+)
+
+type QueueEntry struct {
+	Position    int `gorm:"primaryKey;autoIncrement:false"`
+	AudioDataID uint
+}
+
+const (
+	queueIndexSettingKey    = "queue_index"
+	queueModeSettingKey     = "queue_mode"
+	queuePositionSettingKey = "queue_position"
+	queuePlayingSettingKey  = "queue_playing"
+)
+
+const (
+	// changes that come in a burst are written together
+	stateSaveDelay = time.Second
+	// the position is saved this often while playing, so a crash doesn't lose much of it
+	positionSaveInterval = 15 * time.Second
+)
+
+// what changed since the last save, taken with mp.mu held and written without it
+type stateSnapshot struct {
+	queue      []QueueEntry
+	queueDirty bool
+	settings   []Setting
+}
+
+// must be called with mp.mu held, the queue is written in the background
+func (mp *MusicPlayer) saveQueue() {
+	mp.queueDirty = true
+	mp.savePlaybackState()
+}
+
+// must be called with mp.mu held, the state is written in the background
+func (mp *MusicPlayer) savePlaybackState() {
+	mp.stateDirty = true
+	select {
+	case mp.saveSignal <- struct{}{}:
+	default:
+	}
+}
+
+// must be called with mp.mu held
+func (mp *MusicPlayer) snapshotState() stateSnapshot {
+	var snapshot stateSnapshot
+	if mp.queueDirty {
+		snapshot.queueDirty = true
+		snapshot.queue = make([]QueueEntry, 0, len(mp.playlist))
+		for index, track := range mp.playlist {
+			snapshot.queue = append(snapshot.queue, QueueEntry{Position: index, AudioDataID: track.ID})
+		}
+	}
+	if mp.stateDirty {
+		var position time.Duration
+		if !mp.stopped {
+			position, _ = mp.bot.GetPosition()
+		}
+		snapshot.settings = []Setting{
+			{Key: queueIndexSettingKey, Value: strconv.Itoa(mp.currentIndex)},
+			{Key: queueModeSettingKey, Value: strconv.Itoa(int(mp.mode))},
+			{Key: queuePositionSettingKey, Value: strconv.FormatInt(position.Milliseconds(), 10)},
+			{Key: queuePlayingSettingKey, Value: strconv.FormatBool(!mp.stopped)},
+		}
+	}
+	mp.queueDirty = false
+	mp.stateDirty = false
+	return snapshot
+}
+
+func (mp *MusicPlayer) writeState(snapshot stateSnapshot) {
+	if snapshot.queueDirty {
+		err := mp.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&QueueEntry{}).Error; err != nil {
+				return err
+			}
+			if len(snapshot.queue) == 0 {
+				return nil
+			}
+			return tx.Create(&snapshot.queue).Error
+		})
+		if err != nil {
+			log.Println("Failed to save playlist: ", err)
+		}
+	}
+	if len(snapshot.settings) > 0 {
+		if err := mp.db.Save(&snapshot.settings).Error; err != nil {
+			log.Println("Failed to save playback state: ", err)
+		}
+	}
+}
+
+// takes saveMu first so snapshots are written in the order they were taken
+func (mp *MusicPlayer) flushState() {
+	if mp.db == nil {
+		return
+	}
+	mp.saveMu.Lock()
+	defer mp.saveMu.Unlock()
+	mp.mu.Lock()
+	snapshot := mp.snapshotState()
+	mp.mu.Unlock()
+	mp.writeState(snapshot)
+}
+
+func (mp *MusicPlayer) runStateSaver() {
+	ticker := time.NewTicker(positionSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mp.saveDone:
+			return
+		case <-mp.saveSignal:
+			select {
+			case <-time.After(stateSaveDelay):
+			case <-mp.saveDone:
+				return
+			}
+			mp.flushState()
+		case <-ticker.C:
+			mp.mu.Lock()
+			playing := !mp.stopped
+			mp.stateDirty = mp.stateDirty || playing
+			mp.mu.Unlock()
+			if playing {
+				mp.flushState()
+			}
+		}
+	}
+}
+
+// writes everything right away, including the current position
+func (mp *MusicPlayer) SaveState() {
+	mp.mu.Lock()
+	mp.stateDirty = true
+	mp.mu.Unlock()
+	mp.flushState()
+}
+
+// saves the state one last time and stops saving in the background, call before shutting down
+func (mp *MusicPlayer) Close() {
+	mp.closeOnce.Do(func() {
+		close(mp.saveDone)
+		mp.SaveState()
+	})
+}
+
+func (mp *MusicPlayer) restoreState() error {
+	if mp.db == nil {
+		return nil
+	}
+
+	var entries []QueueEntry
+	if err := mp.db.Order("position").Find(&entries).Error; err != nil {
+		return err
+	}
+	ids := make([]uint, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.AudioDataID)
+	}
+	var tracks []media.AudioData
+	if len(ids) > 0 {
+		if err := mp.db.Find(&tracks, ids).Error; err != nil {
+			return err
+		}
+	}
+	idToTrack := make(map[uint]media.AudioData, len(tracks))
+	for _, t := range tracks {
+		idToTrack[t.ID] = t
+	}
+
+	settings := make(map[string]string)
+	for _, key := range []string{queueIndexSettingKey, queueModeSettingKey, queuePositionSettingKey, queuePlayingSettingKey} {
+		value, ok, err := loadSetting(mp.db, key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			settings[key] = value
+		}
+	}
+	savedIndex, _ := strconv.Atoi(settings[queueIndexSettingKey])
+	mode, _ := strconv.Atoi(settings[queueModeSettingKey])
+	positionMs, _ := strconv.ParseInt(settings[queuePositionSettingKey], 10, 64)
+	playing, _ := strconv.ParseBool(settings[queuePlayingSettingKey])
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.mode = PlaybackMode(mode)
+	mp.playlist = nil
+	clear(mp.entryIDs)
+	mp.currentIndex = 0
+	for index, e := range entries {
+		track, ok := idToTrack[e.AudioDataID]
+		if !ok {
+			// the file is gone, don't let the index drift
+			if index < savedIndex {
+				savedIndex--
+			}
+			continue
+		}
+		mp.playlist = append(mp.playlist, mp.newEntry(track))
+	}
+	if savedIndex >= 0 && savedIndex < len(mp.playlist) {
+		mp.currentIndex = savedIndex
+	}
+	if playing && len(mp.playlist) > 0 {
+		mp.resumeOffset = time.Duration(positionMs) * time.Millisecond
+		mp.resumePending = true
+	}
+	return nil
+}
+
+// starts playback where it was when the bot shut down, if it was playing then
+func (mp *MusicPlayer) ResumePlayback() bool {
+	mp.mu.Lock()
+	if !mp.resumePending {
+		mp.mu.Unlock()
+		return false
+	}
+	mp.resumePending = false
+	mp.startOffset = mp.resumeOffset
+	mp.mu.Unlock()
+	mp.StartPlaylist()
+	return true
+}
@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"errors"
+
+	"github.com/EricZhang456/mumble-music-bot/media"
+	"gorm.io/gorm"
+)
+
+type Playlist struct {
+	gorm.Model
+	Name    string `gorm:"uniqueIndex"`
+	Entries []PlaylistEntry
+}
+
+type PlaylistEntry struct {
+	ID          uint `gorm:"primaryKey"`
+	PlaylistID  uint `gorm:"index"`
+	Position    int
+	AudioDataID uint
+}
+
+var ErrPlaylistNotFound = errors.New("Playlist not found.")
+
+func findPlaylist(db *gorm.DB, name string) (*Playlist, error) {
+	var playlists []Playlist
+	if err := db.Where("name = ?", name).Limit(1).Find(&playlists).Error; err != nil {
+		return nil, err
+	}
+	if len(playlists) == 0 {
+		return nil, ErrPlaylistNotFound
+	}
+	return &playlists[0], nil
+}
+
+// overwrites the playlist if one with the same name exists
+func SavePlaylist(db *gorm.DB, name string, tracks []*media.AudioData) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		playlist, err := findPlaylist(tx, name)
+		if errors.Is(err, ErrPlaylistNotFound) {
+			playlist = &Playlist{Name: name}
+			if err := tx.Create(playlist).Error; err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			if err := tx.Where("playlist_id = ?", playlist.ID).Delete(&PlaylistEntry{}).Error; err != nil {
+				return err
+			}
+			// bump updated_at
+			if err := tx.Save(playlist).Error; err != nil {
+				return err
+			}
+		}
+		if len(tracks) == 0 {
+			return nil
+		}
+		entries := make([]PlaylistEntry, 0, len(tracks))
+		for index, track := range tracks {
+			entries = append(entries, PlaylistEntry{PlaylistID: playlist.ID, Position: index, AudioDataID: track.ID})
+		}
+		return tx.Create(&entries).Error
+	})
+}
+
+// tracks that have since been removed from the library are skipped
+func LoadPlaylistTracks(db *gorm.DB, name string) ([]media.AudioData, error) {
+	playlist, err := findPlaylist(db, name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []PlaylistEntry
+	if err := db.Where("playlist_id = ?", playlist.ID).Order("position").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]uint, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.AudioDataID)
+	}
+	return media.FindAudioDataByIds(db, ids)
+}
+
+func DeletePlaylist(db *gorm.DB, name string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		playlist, err := findPlaylist(tx, name)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("playlist_id = ?", playlist.ID).Delete(&PlaylistEntry{}).Error; err != nil {
+			return err
+		}
+		// hard delete so the name can be reused
+		return tx.Unscoped().Delete(playlist).Error
+	})
+}
+
+type PlaylistSummary struct {
+	Name       string
+	TrackCount int
+}
+
+func ListPlaylists(db *gorm.DB) ([]PlaylistSummary, error) {
+	var summaries []PlaylistSummary
+	err := db.Model(&Playlist{}).
+		Select("playlists.name AS name, COUNT(playlist_entries.id) AS track_count").
+		Joins("LEFT JOIN playlist_entries ON playlist_entries.playlist_id = playlists.id").
+		Group("playlists.id").
+		Order("playlists.name COLLATE NOCASE ASC").
+		Scan(&summaries).Error
+	return summaries, err
+}
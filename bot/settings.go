@@ -0,0 +1,24 @@
+package bot
+
+import "gorm.io/gorm"
+
+// key/value store for bot state that needs to survive restarts
+type Setting struct {
+	Key   string `gorm:"primaryKey"`
+	Value string
+}
+
+func loadSetting(db *gorm.DB, key string) (string, bool, error) {
+	var settings []Setting
+	if err := db.Where("key = ?", key).Limit(1).Find(&settings).Error; err != nil {
+		return "", false, err
+	}
+	if len(settings) == 0 {
+		return "", false, nil
+	}
+	return settings[0].Value, true, nil
+}
+
+func saveSetting(db *gorm.DB, key, value string) error {
+	return db.Save(&Setting{Key: key, Value: value}).Error
+}
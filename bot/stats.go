@@ -0,0 +1,27 @@
+package bot
+
+// told about everything worth counting as it happens, unlike the event bus nothing is ever dropped
+type StatsRecorder interface {
+	// only tracks played from the beginning, resuming one doesn't count
+	TrackPlayed()
+	TrackSkipped()
+	CommandIssued(command string, result CommandResult)
+	PlaybackFailed()
+}
+
+// nil to stop recording
+func (bot *MumbleBot) SetStatsRecorder(stats StatsRecorder) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.stats = stats
+}
+
+// calls record with the recorder if there is one
+func (bot *MumbleBot) recordStats(record func(stats StatsRecorder)) {
+	bot.mu.Lock()
+	stats := bot.stats
+	bot.mu.Unlock()
+	if stats != nil {
+		record(stats)
+	}
+}
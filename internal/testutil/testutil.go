@@ -0,0 +1,66 @@
+// Package testutil has the fixtures the package tests share.
+package testutil
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/media"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// a music player on a bot that never connects, so nothing can actually start playing
+type Player struct {
+	*bot.MusicPlayer
+	Bot    *bot.MumbleBot
+	DB     *gorm.DB
+	Tracks []media.AudioData
+}
+
+func StrPtr(s string) *string {
+	return &s
+}
+
+func IntPtr(i int) *int {
+	return &i
+}
+
+// an in-memory database with the bot's tables, gone once the test is over
+func NewDB(t testing.TB) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the shared in-memory database only goes away once every connection is closed
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&media.AudioData{}, &media.PlaylistFile{}, &bot.Setting{}, &bot.QueueEntry{}, &bot.Playlist{}, &bot.PlaylistEntry{}, &bot.UserRole{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// the tracks are added to the library, Tracks has them with their IDs
+func NewPlayer(t testing.TB, tracks ...media.AudioData) *Player {
+	t.Helper()
+	db := NewDB(t)
+	tracks = append([]media.AudioData(nil), tracks...)
+	if len(tracks) > 0 {
+		if err := db.Create(&tracks).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	mb := bot.CreateMumbleBot("test")
+	mp := bot.CreateMusicPlayer(mb, db)
+	// before the database is closed
+	t.Cleanup(mp.Close)
+	return &Player{MusicPlayer: mp, Bot: mb, DB: db, Tracks: tracks}
+}
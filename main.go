@@ -1,15 +1,23 @@
 package main
 
 import (
+	"crypto/x509"
+	"errors"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 
+	"github.com/EricZhang456/mumble-music-bot/api"
 	"github.com/EricZhang456/mumble-music-bot/bot"
 	"github.com/EricZhang456/mumble-music-bot/media"
+	"github.com/EricZhang456/mumble-music-bot/metrics"
+	"github.com/EricZhang456/mumble-music-bot/mpd"
+	"github.com/EricZhang456/mumble-music-bot/web"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -33,11 +41,27 @@ func main() {
 		log.Fatal("Failed to open database: ", err)
 	}
 
-	if err := db.AutoMigrate(&media.AudioData{}); err != nil {
+	if err := media.RemoveDuplicatePaths(db); err != nil {
+		log.Fatal("Failed to remove duplicate tracks: ", err)
+	}
+	if err := db.AutoMigrate(&media.AudioData{}, &media.PlaylistFile{}, &bot.Setting{}, &bot.QueueEntry{}, &bot.Playlist{}, &bot.PlaylistEntry{}, &bot.UserRole{}); err != nil {
 		log.Fatal("Failed to migrate database: ", err)
 	}
 
+	if err := media.MigrateSearchIndex(db); err != nil {
+		log.Fatal("Failed to create search index (is the bot built with -tags sqlite_fts5?): ", err)
+	}
+
 	scanner := media.CreateAudioScanner(db)
+	coverCachePath := os.Getenv("COVER_CACHE_PATH")
+	if coverCachePath == "" {
+		coverCachePath = filepath.Join(filepath.Dir(dbPath), "covers")
+	}
+	coverCache, err := media.CreateCoverCache(coverCachePath)
+	if err != nil {
+		log.Fatal("Failed to create cover art cache: ", err)
+	}
+	scanner.SetCoverCache(coverCache)
 	log.Println("Scanning audio files.")
 	if err := scanner.ScanAndWriteToDb(musicPath); err != nil {
 		log.Fatal("Failed to scan audio files: ", err)
@@ -56,7 +80,35 @@ func main() {
 		options = append(options, bot.WithPassword(botPassword))
 	}
 
+	certFile := os.Getenv("MUMBLE_CERT_FILE")
+	keyFile := os.Getenv("MUMBLE_KEY_FILE")
+	if certFile != "" && keyFile != "" {
+		cert, err := bot.LoadOrCreateCertificate(certFile, keyFile, botUsername)
+		if err != nil {
+			log.Fatal("Failed to load client certificate: ", err)
+		}
+		options = append(options, bot.WithCertificate(cert))
+	}
+
+	if caFile := os.Getenv("MUMBLE_CA_FILE"); caFile != "" {
+		caPem, err := os.ReadFile(caFile)
+		if err != nil {
+			log.Fatal("Failed to read CA file: ", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			log.Fatal("No certificates found in CA file.")
+		}
+		options = append(options, bot.WithRootCAs(pool))
+	}
+	if fingerprint := strings.TrimSpace(os.Getenv("MUMBLE_SERVER_FINGERPRINT")); fingerprint != "" {
+		options = append(options, bot.WithServerFingerprint(fingerprint))
+	} else if insecure, _ := strconv.ParseBool(os.Getenv("MUMBLE_INSECURE")); insecure {
+		options = append(options, bot.WithInsecureSkipVerify())
+	}
+
 	mb := bot.CreateMumbleBot(botUsername, options...)
+	mb.SetCoverCache(coverCache)
 	mumbleServer := os.Getenv("MUMBLE_SERVER")
 	mumblePortEnv := os.Getenv("MUMBLE_PORT")
 	var mumblePort int
@@ -71,17 +123,113 @@ func main() {
 	}
 
 	log.Println("Joining Mumble server.")
-	mb.Connect(mumbleServer, mumblePort)
+	if err := mb.Connect(mumbleServer, mumblePort); err != nil {
+		log.Println("Failed to connect to Mumble server, retrying: ", err)
+		mb.ConnectInBackground()
+	}
+	if register, _ := strconv.ParseBool(os.Getenv("MUMBLE_REGISTER")); register {
+		mb.RegisterSelf()
+	}
 	mumbleChannel := os.Getenv("MUMBLE_CHANNEL")
 	if mumbleChannel != "" {
 		mb.JoinChannel(mumbleChannel)
 	}
 
-	player := bot.CreateMusicPlayer(mb)
+	player := bot.CreateMusicPlayer(mb, db)
 	commandHandler := bot.CreateCommandHandler(botCommandPrefix, player, db)
+	commandHandler.SetLibraryScanner(scanner, musicPath)
+	if defaultRole := strings.TrimSpace(os.Getenv("DEFAULT_ROLE")); defaultRole != "" {
+		role, ok := bot.ParseRole(defaultRole)
+		if !ok {
+			log.Fatal("Invalid default role.")
+		}
+		commandHandler.SetDefaultRole(role)
+	}
+	if admins := os.Getenv("BOT_ADMIN_CERTS"); admins != "" {
+		commandHandler.SetAdminCertHashes(strings.Split(admins, ","))
+	}
+	exportPath := os.Getenv("PLAYLIST_EXPORT_PATH")
+	if exportPath == "" {
+		exportPath = musicPath
+	}
+	commandHandler.SetPlaylistExportPath(exportPath)
 	mb.SetCommandHandler(commandHandler)
 
+	watcher, err := media.CreateLibraryWatcher(scanner, musicPath)
+	if err != nil {
+		log.Println("Failed to watch music path, new files will need a restart: ", err)
+	} else {
+		defer watcher.Close()
+	}
+
+	// measuring every file can take hours, so it's done in the background once the bot is up
+	if analyze, _ := strconv.ParseBool(os.Getenv("ANALYZE_LOUDNESS")); analyze {
+		scanner.SetLoudnessAnalysis(true)
+		go func() {
+			log.Println("Analyzing loudness in the background.")
+			if err := scanner.ScanAndWriteToDb(musicPath); err != nil {
+				log.Println("Failed to analyze loudness: ", err)
+				return
+			}
+			log.Println("Finished analyzing loudness.")
+		}()
+	}
+
+	if resume, _ := strconv.ParseBool(os.Getenv("RESUME_PLAYBACK")); resume {
+		if player.ResumePlayback() {
+			log.Println("Resuming playback.")
+		}
+	}
+
+	if apiAddr := os.Getenv("HTTP_API_ADDR"); apiAddr != "" {
+		apiServer, err := api.CreateServer(apiAddr, os.Getenv("HTTP_API_TOKEN"), player, db)
+		if err != nil {
+			log.Fatal("Failed to create HTTP API server: ", err)
+		}
+		apiServer.SetCoverCache(coverCache)
+		if origins := os.Getenv("HTTP_API_ORIGINS"); origins != "" {
+			apiServer.SetAllowedOrigins(strings.Split(origins, ","))
+		}
+		apiServer.Handle("GET /", web.Handler())
+		go func() {
+			if err := apiServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Println("HTTP API server stopped: ", err)
+			}
+		}()
+		defer apiServer.Close()
+		log.Println("HTTP API and web interface listening on ", apiAddr)
+	}
+
+	if mpdAddr := os.Getenv("MPD_ADDR"); mpdAddr != "" {
+		mpdServer := mpd.CreateServer(mpdAddr, musicPath, player, db)
+		mpdServer.SetPassword(os.Getenv("MPD_PASSWORD"))
+		go func() {
+			if err := mpdServer.ListenAndServe(); err != nil && !errors.Is(err, mpd.ErrServerClosed) {
+				log.Println("MPD server stopped: ", err)
+			}
+		}()
+		defer mpdServer.Close()
+		log.Println("MPD server listening on ", mpdAddr)
+	}
+
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		botMetrics := metrics.CreateMetrics(player, mb, scanner)
+		defer botMetrics.Close()
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", botMetrics.Handler())
+		metricsServer := &http.Server{Addr: metricsAddr, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Println("Metrics server stopped: ", err)
+			}
+		}()
+		defer metricsServer.Close()
+		log.Println("Serving metrics on ", metricsAddr)
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	<-sig
+
+	player.Close()
 }
@@ -2,18 +2,30 @@ package media
 
 import (
 	"strings"
+	"time"
 
+	"github.com/EricZhang456/mumble-music-bot/utils"
 	"gorm.io/gorm"
 )
 
 type AudioData struct {
 	gorm.Model
-	Path     string
-	Title    string
-	Artists  *string
-	Album    *string
-	TrackNum *int
-	DiscNum  *int
+	Path        string `gorm:"uniqueIndex:idx_audio_data_path,where:deleted_at IS NULL"`
+	Title       string
+	Artists     *string
+	Album       *string
+	TrackNum    *int
+	DiscNum     *int
+	Genre       *string
+	Year        *int
+	AlbumArtist *string
+	Composer    *string
+	Duration    *time.Duration
+	TrackGain   *float64
+	AlbumGain   *float64
+	CoverArt    *string // hash of the thumbnail in the cover cache
+	FileSize    int64
+	ModTime     time.Time
 }
 
 func (ad AudioData) ToString() string {
@@ -36,5 +48,32 @@ func (ad AudioData) ToString() string {
 			sb.WriteString(")")
 		}
 	}
+	if ad.Duration != nil {
+		sb.WriteString(" [")
+		sb.WriteString(utils.FormatDuration(*ad.Duration))
+		sb.WriteString("]")
+	}
 	return sb.String()
 }
+
+// keeps the order of ids, ids that aren't in the DB are skipped
+func FindAudioDataByIds(db *gorm.DB, ids []uint) ([]AudioData, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var found []AudioData
+	if err := db.Find(&found, ids).Error; err != nil {
+		return nil, err
+	}
+	idToTrack := make(map[uint]AudioData, len(found))
+	for _, t := range found {
+		idToTrack[t.ID] = t
+	}
+	tracks := make([]AudioData, 0, len(ids))
+	for _, id := range ids {
+		if t, ok := idToTrack[id]; ok {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks, nil
+}
@@ -1,10 +1,15 @@
 package media
 
 import (
+	"errors"
 	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/EricZhang456/mumble-music-bot/utils"
 	"github.com/dhowden/tag"
@@ -12,9 +17,28 @@ import (
 )
 
 type AudioScanner struct {
-	db *gorm.DB
+	db               *gorm.DB
+	mu               sync.Mutex
+	scanning         bool
+	writeMu          sync.Mutex // held while writing tracks, so the watcher waits for a rescan instead of racing it
+	analyzeLoudness  bool
+	coverCache       *CoverCache
+	lastScanDuration time.Duration
 }
 
+type ScanProgress struct {
+	Walked  int
+	Added   int
+	Updated int
+	Removed int
+	Failed  int
+}
+
+// how many files to process between progress reports
+const scanProgressInterval = 500
+
+var ErrScanInProgress = errors.New("A scan is already in progress.")
+
 var audioExtensions = map[string]struct{}{
 	".aac": {}, ".flac": {}, ".m4a": {}, ".mp3": {}, ".ogg": {}, ".oga": {},
 }
@@ -24,46 +48,227 @@ func CreateAudioScanner(db *gorm.DB) *AudioScanner {
 	return scanner
 }
 
-func getAllAudioFiles(path string) ([]string, error) {
-	var files []string
-	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+// measure loudness with ffmpeg for files without ReplayGain tags, this is slow
+func (ms *AudioScanner) SetLoudnessAnalysis(enabled bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.analyzeLoudness = enabled
+}
+
+// cover art is only extracted once a cache has been set
+func (ms *AudioScanner) SetCoverCache(cache *CoverCache) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.coverCache = cache
+}
+
+func getAllLibraryFiles(path string) (audioFiles []string, playlistFiles []string, err error) {
+	err = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if !d.IsDir() {
-			ext := strings.ToLower(filepath.Ext(path))
-			if _, ok := audioExtensions[ext]; ok {
-				files = append(files, path)
-			}
+		if d.IsDir() {
+			return nil
+		}
+		if isAudioFile(path) {
+			audioFiles = append(audioFiles, path)
+		} else if isPlaylistFile(path) {
+			playlistFiles = append(playlistFiles, path)
 		}
 		return nil
 	})
-	return files, err
+	return audioFiles, playlistFiles, err
+}
+
+func isAudioFile(path string) bool {
+	_, ok := audioExtensions[strings.ToLower(filepath.Ext(path))]
+	return ok
 }
 
 func hasMetadataChanged(existing, scanned AudioData) bool {
+	return hasTagsChanged(existing, scanned) ||
+		existing.FileSize != scanned.FileSize ||
+		!existing.ModTime.Equal(scanned.ModTime) ||
+		!utils.EqualPtr(existing.Duration, scanned.Duration) ||
+		!utils.EqualPtr(existing.TrackGain, scanned.TrackGain) ||
+		!utils.EqualPtr(existing.AlbumGain, scanned.AlbumGain) ||
+		!utils.EqualPtr(existing.CoverArt, scanned.CoverArt)
+}
+
+func hasTagsChanged(existing, scanned AudioData) bool {
 	return existing.Title != scanned.Title ||
 		!utils.EqualPtr(existing.Artists, scanned.Artists) ||
 		!utils.EqualPtr(existing.Album, scanned.Album) ||
 		!utils.EqualPtr(existing.TrackNum, scanned.TrackNum) ||
-		!utils.EqualPtr(existing.DiscNum, scanned.DiscNum)
+		!utils.EqualPtr(existing.DiscNum, scanned.DiscNum) ||
+		!utils.EqualPtr(existing.Genre, scanned.Genre) ||
+		!utils.EqualPtr(existing.Year, scanned.Year) ||
+		!utils.EqualPtr(existing.AlbumArtist, scanned.AlbumArtist) ||
+		!utils.EqualPtr(existing.Composer, scanned.Composer)
+}
+
+// probed values can be reused as long as the file is the one they were probed from
+func isSameFile(existing *AudioData, scanned *AudioData) bool {
+	return existing != nil &&
+		existing.FileSize == scanned.FileSize &&
+		existing.ModTime.Equal(scanned.ModTime) &&
+		!hasTagsChanged(*existing, *scanned)
+}
+
+// asks ffprobe for the length of the file, nil if it can't tell
+func probeDuration(path string) *time.Duration {
+	out, err := exec.Command("ffprobe", "-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path).Output()
+	if err != nil {
+		return nil
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || seconds <= 0 {
+		return nil
+	}
+	duration := time.Duration(seconds * float64(time.Second))
+	return &duration
+}
+
+// probing is slow, so keep the duration we already know about unless the file changed
+func fillDuration(meta *AudioData, existing *AudioData) {
+	if isSameFile(existing, meta) && existing.Duration != nil {
+		meta.Duration = existing.Duration
+		return
+	}
+	meta.Duration = probeDuration(meta.Path)
+}
+
+func (ms *AudioScanner) analyzesLoudness() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.analyzeLoudness
+}
+
+func (ms *AudioScanner) fillTrackGain(meta *AudioData, existing *AudioData) {
+	if meta.TrackGain != nil {
+		return
+	}
+	if isSameFile(existing, meta) && existing.TrackGain != nil {
+		meta.TrackGain = existing.TrackGain
+		return
+	}
+	if ms.analyzesLoudness() {
+		meta.TrackGain = analyzeTrackGain(meta.Path)
+	}
+}
+
+// album gain needs the whole album, so changed albums are only marked here and measured by updateAlbumGains
+func (ms *AudioScanner) fillAlbumGain(meta *AudioData, existing *AudioData, changedAlbums map[albumKey]struct{}) {
+	if meta.AlbumGain != nil || !ms.analyzesLoudness() {
+		return
+	}
+	if isSameFile(existing, meta) && existing.AlbumGain != nil {
+		meta.AlbumGain = existing.AlbumGain
+		return
+	}
+	markAlbum(changedAlbums, meta)
+	if existing != nil {
+		// the track may have moved from another album
+		markAlbum(changedAlbums, existing)
+	}
 }
 
-func getMetadata(path string) (*AudioData, error) {
+// measures each album as a whole and stores the gain on its tracks that aren't tagged with one
+func (ms *AudioScanner) updateAlbumGains(albums map[albumKey]struct{}) error {
+	for key := range albums {
+		var tracks []AudioData
+		if err := ms.db.Where("album = ? AND COALESCE(album_artist, artists, '') = ?", key.album, key.artist).
+			Order("disc_num, track_num, path").
+			Find(&tracks).Error; err != nil {
+			return err
+		}
+		paths := make([]string, 0, len(tracks))
+		var untagged []uint
+		for _, track := range tracks {
+			paths = append(paths, track.Path)
+			if _, albumGain := readFileReplayGain(track.Path); albumGain == nil {
+				untagged = append(untagged, track.ID)
+			}
+		}
+		if len(untagged) == 0 {
+			continue
+		}
+		gain := analyzeAlbumGain(paths)
+		if gain == nil {
+			continue
+		}
+		if err := ms.db.Model(&AudioData{}).Where("id IN ?", untagged).Update("album_gain", *gain).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *AudioScanner) fillProbedFields(meta *AudioData, existing *AudioData) {
+	fillDuration(meta, existing)
+	ms.fillTrackGain(meta, existing)
+}
+
+// embedded art wins over images in the track's directory, folderCovers remembers directories already looked at
+func (ms *AudioScanner) fillCoverArt(meta *AudioData, existing *AudioData, picture *tag.Picture, folderCovers map[string]*string) {
+	ms.mu.Lock()
+	cache := ms.coverCache
+	ms.mu.Unlock()
+	if cache == nil {
+		if existing != nil {
+			meta.CoverArt = existing.CoverArt
+		}
+		return
+	}
+	if picture != nil && len(picture.Data) > 0 {
+		if hash, err := cache.Store(picture.Data); err == nil {
+			meta.CoverArt = &hash
+			return
+		}
+	}
+
+	dir := filepath.Dir(meta.Path)
+	if hash, ok := folderCovers[dir]; ok {
+		meta.CoverArt = hash
+		return
+	}
+	var hash *string
+	if coverPath := findFolderCover(dir); coverPath != "" {
+		if data, err := os.ReadFile(coverPath); err == nil {
+			if h, err := cache.Store(data); err == nil {
+				hash = &h
+			}
+		}
+	}
+	if folderCovers != nil {
+		folderCovers[dir] = hash
+	}
+	meta.CoverArt = hash
+}
+
+// the embedded picture is returned separately, it's too big to keep around
+func getMetadata(path string) (*AudioData, *tag.Picture, error) {
 	fullpath, err := filepath.Abs(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	tags, err := tag.ReadFrom(f)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	title := strings.TrimSpace(tags.Title())
@@ -78,27 +283,98 @@ func getMetadata(path string) (*AudioData, error) {
 	if al := tags.Album(); al != "" {
 		album = &al
 	}
-	var trackNum, discNum *int
+	var genre, albumArtist, composer *string
+	if g := strings.TrimSpace(tags.Genre()); g != "" {
+		genre = &g
+	}
+	if aa := tags.AlbumArtist(); aa != "" {
+		albumArtist = &aa
+	}
+	if c := tags.Composer(); c != "" {
+		composer = &c
+	}
+	var trackNum, discNum, year *int
 	if tn, _ := tags.Track(); tn != 0 {
 		trackNum = &tn
 	}
 	if dn, _ := tags.Disc(); dn != 0 {
 		discNum = &dn
 	}
+	if y := tags.Year(); y != 0 {
+		year = &y
+	}
+	trackGain, albumGain := readReplayGain(tags)
 	return &AudioData{
-		Path:     fullpath,
-		Title:    title,
-		Artists:  artists,
-		Album:    album,
-		TrackNum: trackNum,
-		DiscNum:  discNum,
-	}, nil
+		Path:        fullpath,
+		Title:       title,
+		Artists:     artists,
+		Album:       album,
+		TrackNum:    trackNum,
+		DiscNum:     discNum,
+		Genre:       genre,
+		Year:        year,
+		AlbumArtist: albumArtist,
+		Composer:    composer,
+		TrackGain:   trackGain,
+		AlbumGain:   albumGain,
+		FileSize:    info.Size(),
+		ModTime:     info.ModTime(),
+	}, tags.Picture(), nil
 }
 
 func (ms *AudioScanner) ScanAndWriteToDb(path string) error {
+	_, err := ms.ScanAndWriteToDbWithProgress(path, nil)
+	return err
+}
+
+func (ms *AudioScanner) IsScanning() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.scanning
+}
+
+// how long the last full scan that succeeded took, 0 before the first one
+func (ms *AudioScanner) LastScanDuration() time.Duration {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.lastScanDuration
+}
+
+func (ms *AudioScanner) LibrarySize() (int64, error) {
+	var count int64
+	err := ms.db.Model(&AudioData{}).Count(&count).Error
+	return count, err
+}
+
+// onProgress is called every scanProgressInterval files, the final counts are returned
+func (ms *AudioScanner) ScanAndWriteToDbWithProgress(path string, onProgress func(ScanProgress)) (ScanProgress, error) {
+	var progress ScanProgress
+
+	ms.mu.Lock()
+	if ms.scanning {
+		ms.mu.Unlock()
+		return progress, ErrScanInProgress
+	}
+	ms.scanning = true
+	ms.mu.Unlock()
+	ms.writeMu.Lock()
+	started := time.Now()
+	defer func() {
+		ms.writeMu.Unlock()
+		ms.mu.Lock()
+		ms.scanning = false
+		ms.mu.Unlock()
+	}()
+
+	// paths in the DB are absolute
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return progress, err
+	}
+
 	filesInDb := []AudioData{}
 	if err := ms.db.Find(&filesInDb).Error; err != nil {
-		return err
+		return progress, err
 	}
 
 	pathToAudio := make(map[string]AudioData)
@@ -107,43 +383,75 @@ func (ms *AudioScanner) ScanAndWriteToDb(path string) error {
 	}
 
 	seen := make(map[string]struct{})
+	folderCovers := make(map[string]*string)
+	changedAlbums := make(map[albumKey]struct{})
 	var toAdd, toUpdate, toDelete []AudioData
 
-	files, err := getAllAudioFiles(path)
+	files, playlistFiles, err := getAllLibraryFiles(path)
 	if err != nil {
-		return err
+		return progress, err
 	}
 
 	for _, f := range files {
 		seen[f] = struct{}{}
-		meta, err := getMetadata(f)
+		progress.Walked++
+		if onProgress != nil && progress.Walked%scanProgressInterval == 0 {
+			onProgress(progress)
+		}
+		meta, picture, err := getMetadata(f)
 		if err != nil {
+			progress.Failed++
 			continue
 		}
-		if existing, ok := pathToAudio[f]; !ok {
+		existing, ok := pathToAudio[f]
+		if !ok {
+			ms.fillProbedFields(meta, nil)
+			ms.fillAlbumGain(meta, nil, changedAlbums)
+			ms.fillCoverArt(meta, nil, picture, folderCovers)
 			toAdd = append(toAdd, *meta)
-		} else if hasMetadataChanged(existing, *meta) {
+			progress.Added++
+			continue
+		}
+		ms.fillProbedFields(meta, &existing)
+		ms.fillAlbumGain(meta, &existing, changedAlbums)
+		ms.fillCoverArt(meta, &existing, picture, folderCovers)
+		if hasMetadataChanged(existing, *meta) {
 			meta.ID = existing.ID
+			meta.CreatedAt = existing.CreatedAt
 			toUpdate = append(toUpdate, *meta)
+			progress.Updated++
 		}
 	}
 
 	for _, f := range filesInDb {
 		if _, ok := seen[f.Path]; !ok {
 			toDelete = append(toDelete, f)
+			progress.Removed++
+			if ms.analyzesLoudness() {
+				markAlbum(changedAlbums, &f)
+			}
 		}
 	}
 
-	return ms.db.Transaction(func(tx *gorm.DB) error {
+	err = ms.db.Transaction(func(tx *gorm.DB) error {
 		if len(toAdd) > 0 {
 			if err := tx.Create(&toAdd).Error; err != nil {
 				return err
 			}
+			if err := indexAudioData(tx, toAdd); err != nil {
+				return err
+			}
 		}
 		if len(toUpdate) > 0 {
 			if err := tx.Save(&toUpdate).Error; err != nil {
 				return err
 			}
+			if err := unindexAudioData(tx, toUpdate); err != nil {
+				return err
+			}
+			if err := indexAudioData(tx, toUpdate); err != nil {
+				return err
+			}
 		}
 		if len(toDelete) > 0 {
 			for _, del := range toDelete {
@@ -151,7 +459,107 @@ func (ms *AudioScanner) ScanAndWriteToDb(path string) error {
 					return err
 				}
 			}
+			if err := unindexAudioData(tx, toDelete); err != nil {
+				return err
+			}
 		}
-		return nil
+		return syncPlaylistFiles(tx, playlistFiles)
+	})
+	if err == nil {
+		err = ms.updateAlbumGains(changedAlbums)
+	}
+	if err == nil {
+		ms.mu.Lock()
+		ms.lastScanDuration = time.Since(started)
+		ms.mu.Unlock()
+	}
+	return progress, err
+}
+
+func (ms *AudioScanner) ScanFile(path string) error {
+	ms.writeMu.Lock()
+	defer ms.writeMu.Unlock()
+
+	meta, picture, err := getMetadata(path)
+	if err != nil {
+		return err
+	}
+
+	var existing []AudioData
+	if err := ms.db.Where("path = ?", meta.Path).Limit(1).Find(&existing).Error; err != nil {
+		return err
+	}
+
+	changedAlbums := make(map[albumKey]struct{})
+	if len(existing) == 0 {
+		ms.fillProbedFields(meta, nil)
+		ms.fillAlbumGain(meta, nil, changedAlbums)
+		ms.fillCoverArt(meta, nil, picture, nil)
+	} else {
+		ms.fillProbedFields(meta, &existing[0])
+		ms.fillAlbumGain(meta, &existing[0], changedAlbums)
+		ms.fillCoverArt(meta, &existing[0], picture, nil)
+	}
+
+	err = ms.db.Transaction(func(tx *gorm.DB) error {
+		// looked up again so the row is only created if it's still missing
+		var current []AudioData
+		if err := tx.Where("path = ?", meta.Path).Limit(1).Find(&current).Error; err != nil {
+			return err
+		}
+		if len(current) == 0 {
+			if err := tx.Create(meta).Error; err != nil {
+				return err
+			}
+			return indexAudioData(tx, []AudioData{*meta})
+		}
+		if !hasMetadataChanged(current[0], *meta) {
+			return nil
+		}
+		meta.ID = current[0].ID
+		meta.CreatedAt = current[0].CreatedAt
+		if err := tx.Save(meta).Error; err != nil {
+			return err
+		}
+		if err := unindexAudioData(tx, []AudioData{*meta}); err != nil {
+			return err
+		}
+		return indexAudioData(tx, []AudioData{*meta})
+	})
+	if err != nil {
+		return err
+	}
+	return ms.updateAlbumGains(changedAlbums)
+}
+
+// removes a single file or everything under a directory
+func (ms *AudioScanner) RemovePath(path string) error {
+	ms.writeMu.Lock()
+	defer ms.writeMu.Unlock()
+
+	fullpath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	prefix := fullpath + string(filepath.Separator)
+
+	var toDelete []AudioData
+	if err := ms.db.
+		Where("path = ? OR substr(path, 1, length(?)) = ?", fullpath, prefix, prefix).
+		Find(&toDelete).Error; err != nil {
+		return err
+	}
+
+	return ms.db.Transaction(func(tx *gorm.DB) error {
+		for _, del := range toDelete {
+			if err := tx.Delete(&del).Error; err != nil {
+				return err
+			}
+		}
+		if err := unindexAudioData(tx, toDelete); err != nil {
+			return err
+		}
+		return tx.Where("path = ? OR substr(path, 1, length(?)) = ?", fullpath, prefix, prefix).
+			Delete(&PlaylistFile{}).Error
 	})
 }
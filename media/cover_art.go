@@ -0,0 +1,168 @@
+package media
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dhowden/tag"
+	"golang.org/x/image/draw"
+)
+
+// small enough to inline in a Mumble message or use as an avatar
+const coverThumbnailSize = 128
+
+// images next to the tracks that are used when the file has no embedded picture
+var folderCoverNames = []string{"cover", "folder", "front", "albumart", "album"}
+
+var folderCoverExtensions = []string{".jpg", ".jpeg", ".png"}
+
+// thumbnails are named after the hash of the original picture, so every album stores its art once
+type CoverCache struct {
+	dir string
+}
+
+func CreateCoverCache(dir string) (*CoverCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &CoverCache{dir: dir}, nil
+}
+
+func (cc *CoverCache) Path(hash string) string {
+	return filepath.Join(cc.dir, hash+".jpg")
+}
+
+// returns the JPEG thumbnail of a track's cover art, nil if it has none
+func (cc *CoverCache) Read(data *AudioData) ([]byte, error) {
+	if data.CoverArt == nil {
+		return nil, nil
+	}
+	return os.ReadFile(cc.Path(*data.CoverArt))
+}
+
+// makes a thumbnail of picture unless one exists already and returns its hash
+func (cc *CoverCache) Store(picture []byte) (string, error) {
+	sum := sha256.Sum256(picture)
+	hash := hex.EncodeToString(sum[:16])
+	path := cc.Path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	thumbnail, err := makeThumbnail(picture)
+	if err != nil {
+		return "", err
+	}
+	// write somewhere else first, a half written thumbnail would be served forever
+	tmp, err := os.CreateTemp(cc.dir, hash+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(thumbnail); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func makeThumbnail(picture []byte) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(picture))
+	if err != nil {
+		return nil, err
+	}
+	bounds := src.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return nil, errors.New("Cover art has no pixels.")
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > coverThumbnailSize || height > coverThumbnailSize {
+		if width >= height {
+			height = max(height*coverThumbnailSize/width, 1)
+			width = coverThumbnailSize
+		} else {
+			width = max(width*coverThumbnailSize/height, 1)
+			height = coverThumbnailSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// the first cover image found in dir, empty if there isn't one
+func findFolderCover(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	files := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			files[strings.ToLower(e.Name())] = e.Name()
+		}
+	}
+	for _, name := range folderCoverNames {
+		for _, ext := range folderCoverExtensions {
+			if file, ok := files[name+ext]; ok {
+				return filepath.Join(dir, file)
+			}
+		}
+	}
+	return ""
+}
+
+// returns the embedded picture of an audio file and its MIME type, or nil if there isn't one
+func ReadCoverArt(path string) ([]byte, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	tags, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, "", err
+	}
+	picture := tags.Picture()
+	if picture == nil || len(picture.Data) == 0 {
+		return nil, "", nil
+	}
+	return picture.Data, picture.MIMEType, nil
+}
+
+// reads the cover image next to a track, nil if there isn't one
+func ReadFolderCover(path string) ([]byte, string, error) {
+	coverPath := findFolderCover(filepath.Dir(path))
+	if coverPath == "" {
+		return nil, "", nil
+	}
+	data, err := os.ReadFile(coverPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if strings.EqualFold(filepath.Ext(coverPath), ".png") {
+		return data, "image/png", nil
+	}
+	return data, "image/jpeg", nil
+}
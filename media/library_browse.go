@@ -0,0 +1,211 @@
+package media
+
+import (
+	"math"
+	"strings"
+
+	"github.com/EricZhang456/mumble-music-bot/utils"
+	"gorm.io/gorm"
+)
+
+// tracks are filed under their album artist, or their artists if they don't have one
+const artistColumn = "COALESCE(album_artist, artists)"
+
+type AlbumSummary struct {
+	Album      string
+	Artist     *string
+	Year       *int
+	TrackCount int
+}
+
+type ArtistSummary struct {
+	Artist     string
+	AlbumCount int
+	TrackCount int
+}
+
+type GenreSummary struct {
+	Genre      string
+	TrackCount int
+}
+
+// discs and tracks in order, tracks without numbers go last
+func orderByTrackNumber(db *gorm.DB) *gorm.DB {
+	return db.
+		Order("CASE WHEN disc_num IS NULL THEN 1 ELSE 0 END, disc_num").
+		Order("CASE WHEN track_num IS NULL THEN 1 ELSE 0 END, track_num").
+		Order("title COLLATE NOCASE ASC")
+}
+
+func countDistinct(db *gorm.DB, column string) (int64, error) {
+	var total int64
+	err := db.Model(&AudioData{}).Select("COUNT(DISTINCT " + column + ")").Scan(&total).Error
+	return total, err
+}
+
+func ListAlbums(db *gorm.DB, limit, offset int) ([]AlbumSummary, int64, error) {
+	return listAlbums(db.Where("album IS NOT NULL"), limit, offset)
+}
+
+func ListAlbumsByArtist(db *gorm.DB, artist string, limit, offset int) ([]AlbumSummary, int64, error) {
+	return listAlbums(db.Where("album IS NOT NULL AND "+artistColumn+" = ?", artist), limit, offset)
+}
+
+// albums with the same name by different artists are listed separately
+func groupAlbums(db *gorm.DB) *gorm.DB {
+	return db.Model(&AudioData{}).
+		Select("album, " + artistColumn + " AS artist, MIN(year) AS year, COUNT(*) AS track_count").
+		Group("album, " + artistColumn)
+}
+
+func listAlbums(db *gorm.DB, limit, offset int) ([]AlbumSummary, int64, error) {
+	var total int64
+	if err := db.Session(&gorm.Session{}).Table("(?) AS albums", groupAlbums(db.Session(&gorm.Session{}))).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var albums []AlbumSummary
+	err := groupAlbums(db).
+		Order("album COLLATE NOCASE ASC").
+		Order("artist COLLATE NOCASE ASC").
+		Limit(limit).Offset(offset).
+		Scan(&albums).Error
+	return albums, total, err
+}
+
+func ListArtists(db *gorm.DB, limit, offset int) ([]ArtistSummary, int64, error) {
+	scoped := db.Where(artistColumn + " IS NOT NULL")
+	total, err := countDistinct(scoped.Session(&gorm.Session{}), artistColumn)
+	if err != nil {
+		return nil, 0, err
+	}
+	var artists []ArtistSummary
+	err = scoped.Model(&AudioData{}).
+		Select(artistColumn + " AS artist, COUNT(DISTINCT album) AS album_count, COUNT(*) AS track_count").
+		Group(artistColumn).
+		Order("artist COLLATE NOCASE ASC").
+		Limit(limit).Offset(offset).
+		Scan(&artists).Error
+	return artists, total, err
+}
+
+func ListGenres(db *gorm.DB, limit, offset int) ([]GenreSummary, int64, error) {
+	scoped := db.Where("genre IS NOT NULL")
+	total, err := countDistinct(scoped.Session(&gorm.Session{}), "genre")
+	if err != nil {
+		return nil, 0, err
+	}
+	var genres []GenreSummary
+	err = scoped.Model(&AudioData{}).
+		Select("genre, COUNT(*) AS track_count").
+		Group("genre").
+		Order("genre COLLATE NOCASE ASC").
+		Limit(limit).Offset(offset).
+		Scan(&genres).Error
+	return genres, total, err
+}
+
+func FindAlbumTracks(db *gorm.DB, album string, artist *string) ([]AudioData, error) {
+	var tracks []AudioData
+	err := orderByTrackNumber(db.Where("album = ? AND "+artistColumn+" IS ?", album, artist)).Find(&tracks).Error
+	return tracks, err
+}
+
+// every track by the artist, album by album
+func FindArtistTracks(db *gorm.DB, artist string) ([]AudioData, error) {
+	var tracks []AudioData
+	err := orderByTrackNumber(db.Where(artistColumn+" = ?", artist).
+		Order("CASE WHEN year IS NULL THEN 1 ELSE 0 END, year").
+		Order("album COLLATE NOCASE ASC")).
+		Find(&tracks).Error
+	return tracks, err
+}
+
+func FindGenreTracks(db *gorm.DB, genre string, limit, offset int) ([]AudioData, int64, error) {
+	var total int64
+	if err := db.Model(&AudioData{}).Where("genre = ?", genre).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var tracks []AudioData
+	err := db.Where("genre = ?", genre).
+		Order(artistColumn + " COLLATE NOCASE ASC").
+		Order("album COLLATE NOCASE ASC").
+		Order("CASE WHEN disc_num IS NULL THEN 1 ELSE 0 END, disc_num").
+		Order("CASE WHEN track_num IS NULL THEN 1 ELSE 0 END, track_num").
+		Limit(limit).Offset(offset).
+		Find(&tracks).Error
+	return tracks, total, err
+}
+
+func (album AlbumSummary) FullName() string {
+	if album.Artist == nil {
+		return album.Album
+	}
+	return album.Album + " by " + *album.Artist
+}
+
+// every album with the closest name, "album by artist" narrows it down to one
+func FindClosestAlbums(db *gorm.DB, query string) ([]AlbumSummary, error) {
+	var albums []AlbumSummary
+	if err := groupAlbums(db.Where("album IS NOT NULL")).Scan(&albums).Error; err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(albums)*2)
+	for _, album := range albums {
+		values = append(values, album.Album, album.FullName())
+	}
+	closest := closestValue(values, query)
+	var matches []AlbumSummary
+	for _, album := range albums {
+		if album.Artist != nil && album.FullName() == closest {
+			return []AlbumSummary{album}, nil
+		}
+		if album.Album == closest {
+			matches = append(matches, album)
+		}
+	}
+	return matches, nil
+}
+
+func FindClosestArtist(db *gorm.DB, query string) (string, error) {
+	return findClosestValue(db, artistColumn, query)
+}
+
+func FindClosestGenre(db *gorm.DB, query string) (string, error) {
+	return findClosestValue(db, "genre", query)
+}
+
+// an exact match, then the shortest value containing the query, then the one with the smallest edit distance
+func findClosestValue(db *gorm.DB, column, query string) (string, error) {
+	var values []string
+	if err := db.Model(&AudioData{}).
+		Select("DISTINCT " + column).
+		Where(column + " IS NOT NULL").
+		Scan(&values).Error; err != nil {
+		return "", err
+	}
+	return closestValue(values, query), nil
+}
+
+func closestValue(values []string, query string) string {
+	query = strings.ToLower(strings.TrimSpace(query))
+	containing := ""
+	closest := ""
+	bestDistance := math.MaxInt
+	for _, v := range values {
+		lower := strings.ToLower(v)
+		if lower == query {
+			return v
+		}
+		if strings.Contains(lower, query) && (containing == "" || len(v) < len(containing)) {
+			containing = v
+		}
+		if dist := utils.Levenshtein(query, lower); dist < bestDistance {
+			bestDistance = dist
+			closest = v
+		}
+	}
+	if containing != "" {
+		return containing
+	}
+	return closest
+}
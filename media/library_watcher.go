@@ -0,0 +1,156 @@
+package media
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// files are usually written in several chunks, so wait for things to settle down
+const watcherSettleDelay = 2 * time.Second
+
+type LibraryWatcher struct {
+	scanner *AudioScanner
+	watcher *fsnotify.Watcher
+	pending map[string]struct{}
+	timer   *time.Timer
+	mu      sync.Mutex
+	done    chan struct{}
+}
+
+func CreateLibraryWatcher(scanner *AudioScanner, path string) (*LibraryWatcher, error) {
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	lw := &LibraryWatcher{
+		scanner: scanner,
+		watcher: watcher,
+		pending: make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+	if _, err := lw.watchTree(root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go lw.run()
+	return lw, nil
+}
+
+func (lw *LibraryWatcher) Close() error {
+	close(lw.done)
+	lw.mu.Lock()
+	if lw.timer != nil {
+		lw.timer.Stop()
+	}
+	lw.mu.Unlock()
+	return lw.watcher.Close()
+}
+
+// adds a watch on every directory under root and returns the audio and playlist files found in it
+func (lw *LibraryWatcher) watchTree(root string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return lw.watcher.Add(path)
+		}
+		if isAudioFile(path) || isPlaylistFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (lw *LibraryWatcher) run() {
+	for {
+		select {
+		case <-lw.done:
+			return
+		case event, ok := <-lw.watcher.Events:
+			if !ok {
+				return
+			}
+			lw.handleEvent(event)
+		case err, ok := <-lw.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Library watcher error: ", err)
+		}
+	}
+}
+
+func (lw *LibraryWatcher) handleEvent(event fsnotify.Event) {
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			files, err := lw.watchTree(event.Name)
+			if err != nil {
+				log.Println("Failed to watch new directory: ", err)
+			}
+			lw.queue(files...)
+			return
+		}
+	}
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		// could be a directory, RemovePath takes care of everything under it
+		lw.queue(event.Name)
+		return
+	}
+	if (event.Has(fsnotify.Create) || event.Has(fsnotify.Write)) && (isAudioFile(event.Name) || isPlaylistFile(event.Name)) {
+		lw.queue(event.Name)
+	}
+}
+
+func (lw *LibraryWatcher) queue(paths ...string) {
+	if len(paths) == 0 {
+		return
+	}
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	for _, p := range paths {
+		lw.pending[p] = struct{}{}
+	}
+	if lw.timer == nil {
+		lw.timer = time.AfterFunc(watcherSettleDelay, lw.flush)
+	} else {
+		lw.timer.Reset(watcherSettleDelay)
+	}
+}
+
+func (lw *LibraryWatcher) flush() {
+	lw.mu.Lock()
+	pending := lw.pending
+	lw.pending = make(map[string]struct{})
+	lw.mu.Unlock()
+
+	for path := range pending {
+		info, err := os.Stat(path)
+		switch {
+		case os.IsNotExist(err):
+			err = lw.scanner.RemovePath(path)
+		case err != nil:
+		case info.IsDir():
+			continue
+		case isPlaylistFile(path):
+			err = lw.scanner.AddPlaylistFile(path)
+		default:
+			err = lw.scanner.ScanFile(path)
+		}
+		if err != nil {
+			log.Printf("Failed to update library for %s: %v", path, err)
+		}
+	}
+}
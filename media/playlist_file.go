@@ -0,0 +1,238 @@
+package media
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// a playlist file found in the music path
+type PlaylistFile struct {
+	gorm.Model
+	Path string
+	Name string
+}
+
+var playlistExtensions = map[string]struct{}{
+	".m3u": {}, ".m3u8": {}, ".pls": {}, ".xspf": {},
+}
+
+var ErrUnknownPlaylistFormat = errors.New("Unknown playlist format.")
+
+func isPlaylistFile(path string) bool {
+	_, ok := playlistExtensions[strings.ToLower(filepath.Ext(path))]
+	return ok
+}
+
+func playlistNameFromPath(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// must be called with the scan's transaction
+func syncPlaylistFiles(tx *gorm.DB, paths []string) error {
+	var existing []PlaylistFile
+	if err := tx.Find(&existing).Error; err != nil {
+		return err
+	}
+	known := make(map[string]struct{}, len(existing))
+	seen := make(map[string]struct{}, len(paths))
+	for _, p := range paths {
+		seen[p] = struct{}{}
+	}
+	for _, e := range existing {
+		known[e.Path] = struct{}{}
+		if _, ok := seen[e.Path]; !ok {
+			if err := tx.Delete(&e).Error; err != nil {
+				return err
+			}
+		}
+	}
+	var toAdd []PlaylistFile
+	for _, p := range paths {
+		if _, ok := known[p]; !ok {
+			toAdd = append(toAdd, PlaylistFile{Path: p, Name: playlistNameFromPath(p)})
+		}
+	}
+	if len(toAdd) > 0 {
+		return tx.Create(&toAdd).Error
+	}
+	return nil
+}
+
+func (ms *AudioScanner) AddPlaylistFile(path string) error {
+	ms.writeMu.Lock()
+	defer ms.writeMu.Unlock()
+
+	fullpath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var count int64
+	if err := ms.db.Model(&PlaylistFile{}).Where("path = ?", fullpath).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return ms.db.Create(&PlaylistFile{Path: fullpath, Name: playlistNameFromPath(fullpath)}).Error
+}
+
+// turns an entry into a clean absolute path, relative entries are relative to the playlist
+func resolvePlaylistEntry(entry, baseDir string) string {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return ""
+	}
+	if u, err := url.Parse(entry); err == nil && u.Scheme == "file" {
+		entry = u.Path
+	} else if err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		// http streams and the like, single letter schemes are windows drives
+		return ""
+	}
+	entry = strings.ReplaceAll(entry, "\\", "/")
+	if !filepath.IsAbs(entry) {
+		entry = filepath.Join(baseDir, entry)
+	}
+	return filepath.Clean(entry)
+}
+
+func parseM3U(r io.Reader) ([]string, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
+
+func parsePLS(r io.Reader) ([]string, error) {
+	files := make(map[int]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || !strings.HasPrefix(strings.ToLower(key), "file") {
+			continue
+		}
+		n, err := strconv.Atoi(key[len("file"):])
+		if err != nil {
+			continue
+		}
+		files[n] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	keys := make([]int, 0, len(files))
+	for n := range files {
+		keys = append(keys, n)
+	}
+	sort.Ints(keys)
+	entries := make([]string, 0, len(keys))
+	for _, n := range keys {
+		entries = append(entries, files[n])
+	}
+	return entries, nil
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"`
+}
+
+func parseXSPF(r io.Reader) ([]string, error) {
+	var playlist xspfPlaylist
+	if err := xml.NewDecoder(r).Decode(&playlist); err != nil {
+		return nil, err
+	}
+	entries := make([]string, 0, len(playlist.Tracks))
+	for _, t := range playlist.Tracks {
+		location := t.Location
+		// relative locations are still URI encoded
+		if unescaped, err := url.PathUnescape(location); err == nil && !strings.HasPrefix(location, "file:") {
+			location = unescaped
+		}
+		entries = append(entries, location)
+	}
+	return entries, nil
+}
+
+// returns the absolute paths of every entry, in order
+func ReadPlaylistFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u", ".m3u8":
+		entries, err = parseM3U(f)
+	case ".pls":
+		entries, err = parsePLS(f)
+	case ".xspf":
+		entries, err = parseXSPF(f)
+	default:
+		return nil, ErrUnknownPlaylistFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	baseDir := filepath.Dir(path)
+	paths := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if resolved := resolvePlaylistEntry(e, baseDir); resolved != "" {
+			paths = append(paths, resolved)
+		}
+	}
+	return paths, nil
+}
+
+// looks up tracks by path and keeps the order, the second value is how many entries weren't in the library
+func FindAudioDataByPaths(db *gorm.DB, paths []string) ([]AudioData, int, error) {
+	if len(paths) == 0 {
+		return nil, 0, nil
+	}
+	var found []AudioData
+	if err := db.Where("path IN ?", paths).Find(&found).Error; err != nil {
+		return nil, 0, err
+	}
+	pathToTrack := make(map[string]AudioData, len(found))
+	for _, t := range found {
+		pathToTrack[t.Path] = t
+	}
+	tracks := make([]AudioData, 0, len(paths))
+	missing := 0
+	for _, p := range paths {
+		if t, ok := pathToTrack[p]; ok {
+			tracks = append(tracks, t)
+		} else {
+			missing++
+		}
+	}
+	return tracks, missing, nil
+}
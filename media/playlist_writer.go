@@ -0,0 +1,113 @@
+package media
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+var PlaylistFormats = []string{"m3u8", "pls", "xspf"}
+
+// paths inside baseDir are written relative to it so the file keeps working if the library moves
+func playlistEntryPath(path, baseDir string) string {
+	if baseDir == "" {
+		return path
+	}
+	rel, err := filepath.Rel(baseDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
+}
+
+func playlistEntryTitle(track AudioData) string {
+	if track.Artists != nil && strings.TrimSpace(*track.Artists) != "" {
+		return strings.TrimSpace(*track.Artists) + " - " + track.Title
+	}
+	return track.Title
+}
+
+func durationSeconds(track AudioData) int {
+	if track.Duration == nil {
+		return -1
+	}
+	return int(track.Duration.Seconds())
+}
+
+func writeM3U8(w io.Writer, tracks []AudioData, baseDir string) error {
+	if _, err := fmt.Fprintln(w, "#EXTM3U"); err != nil {
+		return err
+	}
+	for _, t := range tracks {
+		if _, err := fmt.Fprintf(w, "#EXTINF:%d,%s\n%s\n",
+			durationSeconds(t), playlistEntryTitle(t), playlistEntryPath(t.Path, baseDir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePLS(w io.Writer, tracks []AudioData, baseDir string) error {
+	if _, err := fmt.Fprintln(w, "[playlist]"); err != nil {
+		return err
+	}
+	for index, t := range tracks {
+		n := index + 1
+		if _, err := fmt.Fprintf(w, "File%d=%s\nTitle%d=%s\nLength%d=%d\n",
+			n, playlistEntryPath(t.Path, baseDir), n, playlistEntryTitle(t), n, durationSeconds(t)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "NumberOfEntries=%d\nVersion=2\n", len(tracks))
+	return err
+}
+
+func writeXSPF(w io.Writer, tracks []AudioData, baseDir, title string) error {
+	playlist := xspfPlaylist{Version: "1", Title: title}
+	for _, t := range tracks {
+		entry := playlistEntryPath(t.Path, baseDir)
+		var location string
+		if filepath.IsAbs(entry) {
+			location = (&url.URL{Scheme: "file", Path: entry}).String()
+		} else {
+			location = (&url.URL{Path: filepath.ToSlash(entry)}).String()
+		}
+		track := xspfTrack{Location: location, Title: t.Title}
+		if t.Artists != nil {
+			track.Creator = *t.Artists
+		}
+		if t.Album != nil {
+			track.Album = *t.Album
+		}
+		if t.Duration != nil {
+			track.Duration = t.Duration.Milliseconds()
+		}
+		playlist.Tracks = append(playlist.Tracks, track)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(playlist); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// format is one of PlaylistFormats, baseDir is where the file is going to be written
+func WritePlaylist(w io.Writer, format string, tracks []AudioData, baseDir, title string) error {
+	switch strings.ToLower(format) {
+	case "m3u8":
+		return writeM3U8(w, tracks, baseDir)
+	case "pls":
+		return writePLS(w, tracks, baseDir)
+	case "xspf":
+		return writeXSPF(w, tracks, baseDir, title)
+	}
+	return ErrUnknownPlaylistFormat
+}
@@ -0,0 +1,131 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// ReplayGain 2.0 reference level
+const replayGainReferenceLUFS = -18.0
+
+var integratedLoudnessRegexp = regexp.MustCompile(`I:\s+(-?[0-9.]+) LUFS`)
+
+// parses values like "-6.54 dB"
+func parseGain(value string) *float64 {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(value, "dB"), "db"))
+	gain, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &gain
+}
+
+// looks through vorbis comments, ID3 TXXX frames and MP4 freeform atoms
+func readReplayGain(tags tag.Metadata) (trackGain, albumGain *float64) {
+	for key, raw := range tags.Raw() {
+		var value string
+		switch v := raw.(type) {
+		case *tag.Comm:
+			key = v.Description
+			value = v.Text
+		case string:
+			value = v
+		default:
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "replaygain_track_gain":
+			trackGain = parseGain(value)
+		case "replaygain_album_gain":
+			albumGain = parseGain(value)
+		}
+	}
+	return trackGain, albumGain
+}
+
+// albums are told apart by their artist, the same way the browse commands do
+type albumKey struct {
+	album  string
+	artist string
+}
+
+func albumKeyOf(data *AudioData) (albumKey, bool) {
+	if data.Album == nil {
+		return albumKey{}, false
+	}
+	key := albumKey{album: *data.Album}
+	if data.AlbumArtist != nil {
+		key.artist = *data.AlbumArtist
+	} else if data.Artists != nil {
+		key.artist = *data.Artists
+	}
+	return key, true
+}
+
+func markAlbum(albums map[albumKey]struct{}, data *AudioData) {
+	if key, ok := albumKeyOf(data); ok {
+		albums[key] = struct{}{}
+	}
+}
+
+func readFileReplayGain(path string) (trackGain, albumGain *float64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+	tags, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, nil
+	}
+	return readReplayGain(tags)
+}
+
+// runs the file through ffmpeg's EBU R128 filter and returns the gain needed to hit the reference level
+func analyzeTrackGain(path string) *float64 {
+	return analyzeGain([]string{"-i", path, "-filter_complex", "ebur128"})
+}
+
+// plays the files back to back through the EBU R128 filter, so the album is measured as a whole
+func analyzeAlbumGain(paths []string) *float64 {
+	if len(paths) == 1 {
+		return analyzeTrackGain(paths[0])
+	}
+	var args []string
+	var inputs strings.Builder
+	for index, path := range paths {
+		args = append(args, "-i", path)
+		fmt.Fprintf(&inputs, "[%d:a:0]", index)
+	}
+	filter := fmt.Sprintf("%sconcat=n=%d:v=0:a=1,ebur128", inputs.String(), len(paths))
+	return analyzeGain(append(args, "-filter_complex", filter))
+}
+
+func analyzeGain(inputArgs []string) *float64 {
+	args := append([]string{"-nostats", "-hide_banner"}, inputArgs...)
+	cmd := exec.Command("ffmpeg", append(args, "-f", "null", "-")...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil
+	}
+	// the summary at the end is the last match
+	matches := integratedLoudnessRegexp.FindAllStringSubmatch(stderr.String(), -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	loudness, err := strconv.ParseFloat(matches[len(matches)-1][1], 64)
+	if err != nil {
+		return nil
+	}
+	gain := replayGainReferenceLUFS - loudness
+	return &gain
+}
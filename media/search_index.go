@@ -0,0 +1,106 @@
+package media
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const searchIndexTable = "audio_data_fts"
+
+func MigrateSearchIndex(db *gorm.DB) error {
+	if db.Migrator().HasTable(searchIndexTable) {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("CREATE VIRTUAL TABLE " + searchIndexTable + " USING fts5(title, artists, album)").Error; err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO " + searchIndexTable + "(rowid, title, artists, album) " +
+			"SELECT id, title, COALESCE(artists, ''), COALESCE(album, '') FROM audio_data WHERE deleted_at IS NULL").Error
+	})
+}
+
+// older databases can have the same file twice, which the unique index on path doesn't allow, so run this before migrating
+func RemoveDuplicatePaths(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&AudioData{}) {
+		return nil
+	}
+	var duplicates []AudioData
+	if err := db.Where("id NOT IN (SELECT MIN(id) FROM audio_data WHERE deleted_at IS NULL GROUP BY path)").
+		Find(&duplicates).Error; err != nil {
+		return err
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&duplicates).Error; err != nil {
+			return err
+		}
+		if !tx.Migrator().HasTable(searchIndexTable) {
+			return nil
+		}
+		return unindexAudioData(tx, duplicates)
+	})
+}
+
+func indexAudioData(tx *gorm.DB, tracks []AudioData) error {
+	for _, t := range tracks {
+		artists, album := "", ""
+		if t.Artists != nil {
+			artists = *t.Artists
+		}
+		if t.Album != nil {
+			album = *t.Album
+		}
+		if err := tx.Exec("INSERT INTO "+searchIndexTable+"(rowid, title, artists, album) VALUES (?, ?, ?, ?)",
+			t.ID, t.Title, artists, album).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unindexAudioData(tx *gorm.DB, tracks []AudioData) error {
+	for _, t := range tracks {
+		if err := tx.Exec("DELETE FROM "+searchIndexTable+" WHERE rowid = ?", t.ID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// turn user input into an fts5 query where every word is a quoted prefix match
+func buildMatchQuery(query string) string {
+	words := strings.Fields(query)
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		terms = append(terms, `"`+strings.ReplaceAll(w, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func SearchAudioData(db *gorm.DB, query string, limit, offset int) ([]AudioData, int64, error) {
+	match := buildMatchQuery(query)
+	if match == "" {
+		return nil, 0, nil
+	}
+
+	join := "JOIN " + searchIndexTable + " ON " + searchIndexTable + ".rowid = audio_data.id"
+	where := searchIndexTable + " MATCH ?"
+
+	var total int64
+	if err := db.Model(&AudioData{}).Joins(join).Where(where, match).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var tracks []AudioData
+	if err := db.Joins(join).Where(where, match).
+		Order(searchIndexTable + ".rank").
+		Limit(limit).Offset(offset).
+		Find(&tracks).Error; err != nil {
+		return nil, 0, err
+	}
+	return tracks, total, nil
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/media"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mumble_music_bot"
+
+// counters are counted by the bot as things happen, gauges are read whenever Prometheus scrapes
+type Metrics struct {
+	registry       *prometheus.Registry
+	mb             *bot.MumbleBot
+	tracksPlayed   prometheus.Counter
+	tracksSkipped  prometheus.Counter
+	commands       *prometheus.CounterVec
+	playbackErrors prometheus.Counter
+}
+
+func CreateMetrics(mp *bot.MusicPlayer, mb *bot.MumbleBot, scanner *media.AudioScanner) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		mb:       mb,
+		tracksPlayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tracks_played_total",
+			Help:      "Tracks that started playing from the beginning.",
+		}),
+		tracksSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tracks_skipped_total",
+			Help:      "Tracks that were skipped before they finished.",
+		}),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "commands_total",
+			Help:      "Chat commands by command and result.",
+		}, []string{"command", "result"}),
+		playbackErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "playback_errors_total",
+			Help:      "Tracks that ffmpeg failed to play.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.tracksPlayed,
+		m.tracksSkipped,
+		m.commands,
+		m.playbackErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "queue_length",
+			Help:      "Tracks in the playlist.",
+		}, func() float64 {
+			return float64(len(mp.GetPlaylist()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "library_tracks",
+			Help:      "Tracks in the library.",
+		}, func() float64 {
+			size, err := scanner.LibrarySize()
+			if err != nil {
+				log.Println("Failed to count library tracks: ", err)
+				return math.NaN()
+			}
+			return float64(size)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "library_scan_duration_seconds",
+			Help:      "How long the last full library scan took.",
+		}, func() float64 {
+			return scanner.LastScanDuration().Seconds()
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "mumble_connected",
+			Help:      "1 while connected to the Mumble server.",
+		}, func() float64 {
+			if mb.IsConnected() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "mumble_channel_users",
+			Help:      "Users in the bot's channel, not counting the bot.",
+		}, func() float64 {
+			return float64(mb.CountChannelUsers())
+		}),
+	)
+
+	mb.SetStatsRecorder(m)
+	return m
+}
+
+func (m *Metrics) TrackPlayed() {
+	m.tracksPlayed.Inc()
+}
+
+func (m *Metrics) TrackSkipped() {
+	m.tracksSkipped.Inc()
+}
+
+func (m *Metrics) CommandIssued(command string, result bot.CommandResult) {
+	m.commands.WithLabelValues(command, string(result)).Inc()
+}
+
+func (m *Metrics) PlaybackFailed() {
+	m.playbackErrors.Inc()
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// stops counting
+func (m *Metrics) Close() {
+	m.mb.SetStatsRecorder(nil)
+}
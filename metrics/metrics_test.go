@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/internal/testutil"
+	"github.com/EricZhang456/mumble-music-bot/media"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	player := testutil.NewPlayer(t, media.AudioData{Path: "/music/a.flac", Title: "Alpha"}, media.AudioData{Path: "/music/b.flac", Title: "Bravo"})
+	m := CreateMetrics(player.MusicPlayer, player.Bot, media.CreateAudioScanner(player.DB))
+	t.Cleanup(m.Close)
+
+	player.AddToPlaylist(player.Tracks[0])
+	handler := bot.CreateCommandHandler("!", player.MusicPlayer, player.DB)
+	handler.SetDefaultRole(bot.RoleListener)
+	sender := &bot.CommandSender{Name: "listener"}
+	handler.HandleCommand(sender, "!tracks")
+	handler.HandleCommand(sender, "!tracks 2")
+	handler.HandleCommand(sender, "!info")
+	handler.HandleCommand(sender, "!clear")
+
+	body := scrape(t, m)
+	for _, line := range []string{
+		`mumble_music_bot_commands_total{command="tracks",result="ok"} 2`,
+		`mumble_music_bot_commands_total{command="info",result="usage"} 1`,
+		`mumble_music_bot_commands_total{command="clear",result="denied"} 1`,
+		"mumble_music_bot_tracks_played_total 0",
+		"mumble_music_bot_tracks_skipped_total 0",
+		"mumble_music_bot_playback_errors_total 0",
+		"mumble_music_bot_queue_length 1",
+		"mumble_music_bot_library_tracks 2",
+		"mumble_music_bot_library_scan_duration_seconds 0",
+		"mumble_music_bot_mumble_connected 0",
+		"mumble_music_bot_mumble_channel_users 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+
+	// nothing is counted once the metrics are closed
+	m.Close()
+	handler.HandleCommand(sender, "!tracks")
+	if body := scrape(t, m); !strings.Contains(body, `mumble_music_bot_commands_total{command="tracks",result="ok"} 2`+"\n") {
+		t.Error("a command was counted after Close")
+	}
+}
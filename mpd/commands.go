@@ -0,0 +1,803 @@
+package mpd
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/media"
+	"github.com/dhowden/tag"
+)
+
+var errClose = errors.New("Connection closed by the client.")
+
+type command struct {
+	minArgs int
+	maxArgs int // -1 for no limit
+	public  bool
+	run     func(c *conn, r *response, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":          {public: true, run: (*conn).ping},
+		"close":         {public: true, run: (*conn).close},
+		"password":      {minArgs: 1, maxArgs: 1, public: true, run: (*conn).checkPassword},
+		"binarylimit":   {minArgs: 1, maxArgs: 1, public: true, run: (*conn).setBinaryLimit},
+		"commands":      {public: true, run: (*conn).listCommands},
+		"notcommands":   {public: true, run: (*conn).listNotCommands},
+		"tagtypes":      {maxArgs: -1, run: (*conn).tagTypes},
+		"outputs":       {run: (*conn).outputs},
+		"urlhandlers":   {run: (*conn).ping},
+		"decoders":      {run: (*conn).ping},
+		"listplaylists": {run: (*conn).ping},
+
+		"status":       {run: (*conn).status},
+		"currentsong":  {run: (*conn).currentSong},
+		"stats":        {run: (*conn).stats},
+		"playlistinfo": {maxArgs: 1, run: (*conn).playlistInfo},
+		"playlistid":   {maxArgs: 1, run: (*conn).playlistID},
+		"plchanges":    {minArgs: 1, maxArgs: 2, run: (*conn).playlistChanges},
+
+		"add":      {minArgs: 1, maxArgs: 2, run: (*conn).add},
+		"addid":    {minArgs: 1, maxArgs: 2, run: (*conn).addID},
+		"delete":   {minArgs: 1, maxArgs: 1, run: (*conn).delete},
+		"deleteid": {minArgs: 1, maxArgs: 1, run: (*conn).deleteID},
+		"move":     {minArgs: 2, maxArgs: 2, run: (*conn).move},
+		"clear":    {run: (*conn).clear},
+
+		"play":    {maxArgs: 1, run: (*conn).play},
+		"playid":  {maxArgs: 1, run: (*conn).playID},
+		"pause":   {maxArgs: 1, run: (*conn).pause},
+		"next":    {run: (*conn).next},
+		"stop":    {run: (*conn).stop},
+		"seekcur": {minArgs: 1, maxArgs: 1, run: (*conn).seekCurrent},
+		"random":  {minArgs: 1, maxArgs: 1, run: (*conn).setRandom},
+		"repeat":  {minArgs: 1, maxArgs: 1, run: (*conn).setRepeat},
+
+		"search": {minArgs: 1, maxArgs: -1, run: (*conn).search},
+		"find":   {minArgs: 1, maxArgs: -1, run: (*conn).find},
+		"list":   {minArgs: 1, maxArgs: -1, run: (*conn).list},
+		"lsinfo": {maxArgs: 1, run: (*conn).lsInfo},
+
+		"albumart":    {minArgs: 2, maxArgs: 2, run: (*conn).albumArt},
+		"readpicture": {minArgs: 2, maxArgs: 2, run: (*conn).readPicture},
+	}
+}
+
+func playerError(err error) error {
+	return ack(ackErrorPlayerSync, "%s", err.Error())
+}
+
+func (c *conn) writeSong(r *response, track *media.AudioData) {
+	r.field("file", c.s.fileURI(track.Path))
+	r.field("Last-Modified", track.UpdatedAt.UTC().Format(time.RFC3339))
+	r.optional("Artist", track.Artists)
+	r.optional("AlbumArtist", track.AlbumArtist)
+	r.field("Title", track.Title)
+	r.optional("Album", track.Album)
+	r.optionalInt("Track", track.TrackNum)
+	r.optionalInt("Disc", track.DiscNum)
+	r.optionalInt("Date", track.Year)
+	r.optional("Genre", track.Genre)
+	r.optional("Composer", track.Composer)
+	if track.Duration != nil {
+		r.field("Time", int(track.Duration.Round(time.Second).Seconds()))
+		r.field("duration", fmt.Sprintf("%.3f", track.Duration.Seconds()))
+	}
+}
+
+// song ids are the player's queue IDs, which start at 1 since libmpdclient treats an id of 0 as not being in the playlist
+func (c *conn) writeQueueSong(r *response, queued bot.QueuedTrack, index int) {
+	c.writeSong(r, queued.Track)
+	r.field("Pos", index)
+	r.field("Id", queued.ID)
+}
+
+// the position of the song with the id
+func (c *conn) findID(s string) (int, error) {
+	id, err := parseInt(s)
+	if err != nil {
+		return 0, err
+	}
+	index := c.s.mp.FindQueuedTrack(id)
+	if index < 0 {
+		return 0, ack(ackErrorNoExist, "No such song")
+	}
+	return index, nil
+}
+
+// the playing song and its position, false when stopped
+func (c *conn) currentQueuedTrack() (bot.QueuedTrack, int, bool) {
+	queued := c.s.mp.GetQueuedTracks()
+	index := c.s.mp.GetCurrentIndex()
+	if index < 0 || index >= len(queued) {
+		return bot.QueuedTrack{}, 0, false
+	}
+	return queued[index], index, true
+}
+
+// connection
+
+func (c *conn) ping(r *response, args []string) error {
+	return nil
+}
+
+func (c *conn) close(r *response, args []string) error {
+	return errClose
+}
+
+func (c *conn) checkPassword(r *response, args []string) error {
+	if c.s.password == "" || subtle.ConstantTimeCompare([]byte(args[0]), []byte(c.s.password)) != 1 {
+		return ack(ackErrorPassword, "incorrect password")
+	}
+	c.authorized = true
+	return nil
+}
+
+func (c *conn) setBinaryLimit(r *response, args []string) error {
+	limit, err := parseInt(args[0])
+	if err != nil {
+		return err
+	}
+	if limit < 64 {
+		return ack(ackErrorArg, "Value too small")
+	}
+	c.binaryLimit = limit
+	return nil
+}
+
+func (c *conn) commandNames(allowed bool) []string {
+	var names []string
+	for name, cmd := range commands {
+		if (c.authorized || cmd.public) == allowed {
+			names = append(names, name)
+		}
+	}
+	if allowed {
+		names = append(names, "command_list_begin", "command_list_ok_begin", "command_list_end")
+		if c.authorized {
+			names = append(names, "idle", "noidle")
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (c *conn) listCommands(r *response, args []string) error {
+	for _, name := range c.commandNames(true) {
+		r.field("command", name)
+	}
+	return nil
+}
+
+func (c *conn) listNotCommands(r *response, args []string) error {
+	for _, name := range c.commandNames(false) {
+		r.field("command", name)
+	}
+	return nil
+}
+
+// every tag is always sent, so the clear/enable/disable/all subcommands are accepted and ignored
+func (c *conn) tagTypes(r *response, args []string) error {
+	if len(args) > 0 {
+		return nil
+	}
+	names := make([]string, 0, len(tagNames))
+	for _, name := range tagNames {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		r.field("tagtype", name)
+	}
+	return nil
+}
+
+// the bot only plays into Mumble
+func (c *conn) outputs(r *response, args []string) error {
+	r.field("outputid", 0)
+	r.field("outputname", "Mumble")
+	r.field("plugin", "mumble")
+	r.field("outputenabled", 1)
+	return nil
+}
+
+// status
+
+func (c *conn) status(r *response, args []string) error {
+	mp := c.s.mp
+	playlist := mp.GetQueuedTracks()
+	mode := mp.GetMode()
+	r.field("volume", mp.GetVolume())
+	r.field("repeat", boolInt(mode == bot.Repeat || mode == bot.ShuffleRepeat))
+	r.field("random", boolInt(mode == bot.Shuffle || mode == bot.ShuffleRepeat))
+	r.field("single", 0)
+	r.field("consume", 0)
+	r.field("playlist", playlistVersion(playlist))
+	r.field("playlistlength", len(playlist))
+
+	current, index, ok := c.currentQueuedTrack()
+	switch {
+	case !ok:
+		r.field("state", "stop")
+		return nil
+	case mp.IsPaused():
+		r.field("state", "pause")
+	default:
+		r.field("state", "play")
+	}
+	r.field("song", index)
+	r.field("songid", current.ID)
+	position, _ := mp.GetPosition()
+	r.field("elapsed", fmt.Sprintf("%.3f", position.Seconds()))
+	if duration := current.Track.Duration; duration != nil {
+		r.field("time", fmt.Sprintf("%d:%d", int(position.Seconds()), int(duration.Round(time.Second).Seconds())))
+		r.field("duration", fmt.Sprintf("%.3f", duration.Seconds()))
+	}
+	return nil
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *conn) currentSong(r *response, args []string) error {
+	if current, index, ok := c.currentQueuedTrack(); ok {
+		c.writeQueueSong(r, current, index)
+	}
+	return nil
+}
+
+func (c *conn) stats(r *response, args []string) error {
+	var stats struct {
+		Songs    int64
+		Artists  int64
+		Albums   int64
+		Playtime sql.NullInt64
+	}
+	if err := c.s.db.Model(&media.AudioData{}).
+		Select("COUNT(*) AS songs, COUNT(DISTINCT artists) AS artists, COUNT(DISTINCT album) AS albums, SUM(duration) AS playtime").
+		Scan(&stats).Error; err != nil {
+		return err
+	}
+	r.field("artists", stats.Artists)
+	r.field("albums", stats.Albums)
+	r.field("songs", stats.Songs)
+	r.field("uptime", int(time.Since(c.s.started).Seconds()))
+	r.field("db_playtime", int(time.Duration(stats.Playtime.Int64).Seconds()))
+	r.field("playtime", 0)
+	return nil
+}
+
+// queue
+
+func (c *conn) writePlaylist(r *response, start, end int) error {
+	playlist := c.s.mp.GetQueuedTracks()
+	end = min(end, len(playlist))
+	if start > len(playlist) || (start == len(playlist) && start != 0) {
+		return ack(ackErrorArg, "Bad song index")
+	}
+	for index := start; index < end; index++ {
+		c.writeQueueSong(r, playlist[index], index)
+	}
+	return nil
+}
+
+func (c *conn) playlistInfo(r *response, args []string) error {
+	start, end := 0, len(c.s.mp.GetPlaylist())
+	if len(args) > 0 {
+		var err error
+		if start, end, err = parseRange(args[0], end); err != nil {
+			return err
+		}
+	}
+	return c.writePlaylist(r, start, end)
+}
+
+func (c *conn) playlistID(r *response, args []string) error {
+	if len(args) == 0 {
+		return c.writePlaylist(r, 0, len(c.s.mp.GetPlaylist()))
+	}
+	index, err := c.findID(args[0])
+	if err != nil {
+		return err
+	}
+	return c.writePlaylist(r, index, index+1)
+}
+
+// there's no history of changes, so any other version gets the whole playlist
+func (c *conn) playlistChanges(r *response, args []string) error {
+	version, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return ack(ackErrorArg, "Integer expected: %s", args[0])
+	}
+	playlist := c.s.mp.GetQueuedTracks()
+	if uint32(version) == playlistVersion(playlist) {
+		return nil
+	}
+	start, end := 0, len(playlist)
+	if len(args) > 1 {
+		if start, end, err = parseRange(args[1], end); err != nil {
+			return err
+		}
+	}
+	return c.writePlaylist(r, start, end)
+}
+
+// a file, or every track under a directory, "/" is the whole library
+func (c *conn) findTracks(uri string) ([]media.AudioData, error) {
+	path := c.s.absPath(uri)
+	var tracks []media.AudioData
+	if err := c.s.db.Where("path = ?", path).Limit(1).Find(&tracks).Error; err != nil {
+		return nil, err
+	}
+	if len(tracks) > 0 {
+		return tracks, nil
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	if err := c.s.db.Where("SUBSTR(path, 1, LENGTH(?)) = ?", prefix, prefix).Order("path").Find(&tracks).Error; err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, ack(ackErrorNoExist, "No such directory")
+	}
+	return tracks, nil
+}
+
+// returns the id of the first added track
+func (c *conn) addTracks(uri string, position []string) (int, error) {
+	tracks, err := c.findTracks(uri)
+	if err != nil {
+		return 0, err
+	}
+	insertAt := len(c.s.mp.GetPlaylist())
+	if len(position) > 0 {
+		if insertAt, err = parseInt(position[0]); err != nil {
+			return 0, err
+		}
+	}
+	id, err := c.s.mp.InsertIntoPlaylist(insertAt, tracks)
+	if err != nil {
+		return 0, ack(ackErrorArg, "Bad song index")
+	}
+	return id, nil
+}
+
+func (c *conn) add(r *response, args []string) error {
+	_, err := c.addTracks(args[0], args[1:])
+	return err
+}
+
+func (c *conn) addID(r *response, args []string) error {
+	id, err := c.addTracks(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	r.field("Id", id)
+	return nil
+}
+
+func (c *conn) removeRange(start, end int) error {
+	switch c.s.mp.RemoveRangeFromPlaylist(start, end) {
+	case bot.OutOfRange:
+		return ack(ackErrorArg, "Bad song index")
+	case bot.Playing:
+		return ack(ackErrorPlayerSync, "You can't remove the track that's currently playing.")
+	}
+	return nil
+}
+
+func (c *conn) delete(r *response, args []string) error {
+	start, end, err := parseRange(args[0], len(c.s.mp.GetPlaylist()))
+	if err != nil {
+		return err
+	}
+	return c.removeRange(start, end)
+}
+
+func (c *conn) deleteID(r *response, args []string) error {
+	index, err := c.findID(args[0])
+	if err != nil {
+		return err
+	}
+	return c.removeRange(index, index+1)
+}
+
+// the tracks in the range end up starting at the new position, in the same order
+func (c *conn) move(r *response, args []string) error {
+	length := len(c.s.mp.GetPlaylist())
+	start, end, err := parseRange(args[0], length)
+	if err != nil {
+		return err
+	}
+	to, err := parseInt(args[1])
+	if err != nil {
+		return err
+	}
+	if err := c.s.mp.MoveRangeInPlaylist(start, end, to); err != nil {
+		return ack(ackErrorArg, "Bad song index")
+	}
+	return nil
+}
+
+func (c *conn) clear(r *response, args []string) error {
+	c.s.mp.ClearPlaylist()
+	return nil
+}
+
+// playback
+
+func (c *conn) playAt(index int) error {
+	if err := c.s.mp.PlayIndex(index); err != nil {
+		return ack(ackErrorArg, "Bad song index")
+	}
+	return nil
+}
+
+// without a position it resumes or starts from where the playlist is
+func (c *conn) resume() error {
+	mp := c.s.mp
+	if mp.IsPaused() {
+		if err := mp.Unpause(); err != nil {
+			return playerError(err)
+		}
+	} else if mp.GetCurrentTrack() == nil {
+		mp.StartPlaylist()
+	}
+	return nil
+}
+
+func (c *conn) play(r *response, args []string) error {
+	if len(args) == 0 {
+		return c.resume()
+	}
+	index, err := parseInt(args[0])
+	if err != nil {
+		return err
+	}
+	return c.playAt(index)
+}
+
+func (c *conn) playID(r *response, args []string) error {
+	if len(args) == 0 {
+		return c.resume()
+	}
+	index, err := c.findID(args[0])
+	if err != nil {
+		return err
+	}
+	return c.playAt(index)
+}
+
+// toggles without an argument, does nothing when stopped
+func (c *conn) pause(r *response, args []string) error {
+	mp := c.s.mp
+	if mp.GetCurrentTrack() == nil {
+		return nil
+	}
+	pause := !mp.IsPaused()
+	if len(args) > 0 {
+		var err error
+		if pause, err = parseBool(args[0]); err != nil {
+			return err
+		}
+	}
+	if pause == mp.IsPaused() {
+		return nil
+	}
+	var err error
+	if pause {
+		err = mp.Pause()
+	} else {
+		err = mp.Unpause()
+	}
+	if err != nil {
+		return playerError(err)
+	}
+	return nil
+}
+
+func (c *conn) next(r *response, args []string) error {
+	if err := c.s.mp.Skip(); err != nil {
+		return playerError(err)
+	}
+	return nil
+}
+
+func (c *conn) stop(r *response, args []string) error {
+	c.s.mp.StopPlaylist()
+	return nil
+}
+
+func (c *conn) seekCurrent(r *response, args []string) error {
+	if strings.HasPrefix(args[0], "+") || strings.HasPrefix(args[0], "-") {
+		return ack(ackErrorArg, "Relative seeking is not supported.")
+	}
+	offset, err := parseSeconds(args[0])
+	if err != nil {
+		return err
+	}
+	if err := c.s.mp.Seek(offset); err != nil {
+		return playerError(err)
+	}
+	return nil
+}
+
+// random and repeat are two halves of the playback mode
+func (c *conn) setMode(random, repeat bool) {
+	mode := bot.Single
+	switch {
+	case random && repeat:
+		mode = bot.ShuffleRepeat
+	case random:
+		mode = bot.Shuffle
+	case repeat:
+		mode = bot.Repeat
+	}
+	if mode != c.s.mp.GetMode() {
+		c.s.mp.SetMode(mode)
+	}
+}
+
+func (c *conn) setRandom(r *response, args []string) error {
+	random, err := parseBool(args[0])
+	if err != nil {
+		return err
+	}
+	mode := c.s.mp.GetMode()
+	c.setMode(random, mode == bot.Repeat || mode == bot.ShuffleRepeat)
+	return nil
+}
+
+func (c *conn) setRepeat(r *response, args []string) error {
+	repeat, err := parseBool(args[0])
+	if err != nil {
+		return err
+	}
+	mode := c.s.mp.GetMode()
+	c.setMode(mode == bot.Shuffle || mode == bot.ShuffleRepeat, repeat)
+	return nil
+}
+
+// library
+
+func (c *conn) search(r *response, args []string) error {
+	return c.findSongs(r, args, true)
+}
+
+func (c *conn) find(r *response, args []string) error {
+	return c.findSongs(r, args, false)
+}
+
+// a filter, then optionally sort TAG and window START:END
+func (c *conn) findSongs(r *response, args []string, search bool) error {
+	query := c.s.db.Model(&media.AudioData{})
+	var sorted bool
+	for len(args) >= 2 {
+		keyword, value := strings.ToLower(args[len(args)-2]), args[len(args)-1]
+		if keyword == "sort" {
+			tag, descending := strings.CutPrefix(value, "-")
+			column, ok := tagColumns[strings.ToLower(tag)]
+			if !ok {
+				return ack(ackErrorArg, "Unknown tag type: %s", tag)
+			}
+			if descending {
+				column += " DESC"
+			}
+			query = query.Order(column)
+			sorted = true
+		} else if keyword == "window" {
+			start, end, err := parseRange(value, -1)
+			if err != nil {
+				return err
+			}
+			if end >= 0 {
+				query = query.Limit(end - start)
+			}
+			query = query.Offset(start)
+		} else {
+			break
+		}
+		args = args[:len(args)-2]
+	}
+	f, err := c.parseFilter(args, search)
+	if err != nil {
+		return err
+	}
+	if f.empty() {
+		return ack(ackErrorArg, "Filter needed.")
+	}
+	if !sorted {
+		query = query.Order("path")
+	}
+	var tracks []media.AudioData
+	if err := query.Where(f.where(), f.args...).Find(&tracks).Error; err != nil {
+		return err
+	}
+	for index := range tracks {
+		c.writeSong(r, &tracks[index])
+	}
+	return nil
+}
+
+// list TAG [FILTER] [group TAG]..., an album list can also be filtered by just an artist name
+func (c *conn) list(r *response, args []string) error {
+	tag := strings.ToLower(args[0])
+	column, ok := tagColumns[tag]
+	if !ok {
+		return ack(ackErrorArg, "Unknown tag type: %s", args[0])
+	}
+	args = args[1:]
+
+	var groups []string
+	for len(args) >= 2 && strings.ToLower(args[len(args)-2]) == "group" {
+		group := strings.ToLower(args[len(args)-1])
+		if _, ok := tagColumns[group]; !ok {
+			return ack(ackErrorArg, "Unknown tag type: %s", args[len(args)-1])
+		}
+		groups = append([]string{group}, groups...)
+		args = args[:len(args)-2]
+	}
+
+	if tag == "album" && len(args) == 1 && !strings.HasPrefix(args[0], "(") {
+		args = []string{"artist", args[0]}
+	}
+	f, err := c.parseFilter(args, false)
+	if err != nil {
+		return err
+	}
+
+	selected := make([]string, 0, len(groups)+1)
+	for _, group := range groups {
+		selected = append(selected, "CAST("+tagColumns[group]+" AS TEXT)")
+	}
+	selected = append(selected, "CAST("+column+" AS TEXT)")
+	query := c.s.db.Model(&media.AudioData{}).
+		Select("DISTINCT " + strings.Join(selected, ", ")).
+		Where(column + " IS NOT NULL")
+	if !f.empty() {
+		query = query.Where(f.where(), f.args...)
+	}
+	for _, s := range selected {
+		query = query.Order(s + " COLLATE NOCASE")
+	}
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	values := make([]sql.NullString, len(selected))
+	dest := make([]any, len(selected))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	previous := make([]*string, len(groups))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		// a group's value is only repeated when it changes
+		for i, group := range groups {
+			if previous[i] == nil || *previous[i] != values[i].String {
+				value := values[i].String
+				previous[i] = &value
+				r.field(tagNames[group], value)
+			}
+		}
+		r.field(tagNames[tag], values[len(groups)].String)
+	}
+	return rows.Err()
+}
+
+// the subdirectories and tracks directly in a directory
+func (c *conn) lsInfo(r *response, args []string) error {
+	uri := ""
+	if len(args) > 0 {
+		uri = strings.Trim(args[0], "/")
+	}
+	tracks, err := c.findTracks(uri)
+	if err != nil {
+		return err
+	}
+	dir := c.s.absPath(uri)
+	if len(tracks) == 1 && tracks[0].Path == dir {
+		c.writeSong(r, &tracks[0])
+		return nil
+	}
+
+	prefix := dir + "/"
+	var songs []*media.AudioData
+	seen := make(map[string]bool)
+	var dirs []string
+	for index := range tracks {
+		rest := strings.TrimPrefix(tracks[index].Path, prefix)
+		if sub, _, nested := strings.Cut(rest, "/"); nested {
+			if !seen[sub] {
+				seen[sub] = true
+				dirs = append(dirs, sub)
+			}
+			continue
+		}
+		songs = append(songs, &tracks[index])
+	}
+	slices.SortFunc(dirs, func(a, b string) int {
+		return cmp.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	for _, sub := range dirs {
+		if uri == "" {
+			r.field("directory", sub)
+		} else {
+			r.field("directory", uri+"/"+sub)
+		}
+	}
+	for _, song := range songs {
+		c.writeSong(r, song)
+	}
+	return nil
+}
+
+// albumart is the image in the track's folder, readpicture is the one embedded in the file
+func (c *conn) albumArt(r *response, args []string) error {
+	return c.sendPicture(r, args, false)
+}
+
+func (c *conn) readPicture(r *response, args []string) error {
+	return c.sendPicture(r, args, true)
+}
+
+func (c *conn) sendPicture(r *response, args []string, embedded bool) error {
+	offset, err := parseInt(args[1])
+	if err != nil {
+		return err
+	}
+	var tracks []media.AudioData
+	if err := c.s.db.Where("path = ?", c.s.absPath(args[0])).Limit(1).Find(&tracks).Error; err != nil {
+		return err
+	}
+	if len(tracks) == 0 {
+		return ack(ackErrorNoExist, "No such file")
+	}
+	var data []byte
+	var mime string
+	if embedded {
+		data, mime, err = media.ReadCoverArt(tracks[0].Path)
+		if errors.Is(err, tag.ErrNoTagsFound) {
+			err = nil
+		}
+	} else {
+		data, mime, err = media.ReadFolderCover(tracks[0].Path)
+	}
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		// readpicture answers with nothing when there's no picture, albumart with an error
+		if embedded {
+			return nil
+		}
+		return ack(ackErrorNoExist, "No file exists")
+	}
+	if offset < 0 || offset > len(data) {
+		return ack(ackErrorArg, "Offset too large")
+	}
+	r.field("size", len(data))
+	if embedded && mime != "" {
+		r.field("type", mime)
+	}
+	r.binary(data[offset:min(offset+c.binaryLimit, len(data))])
+	return nil
+}
@@ -0,0 +1,258 @@
+package mpd
+
+import (
+	"strings"
+)
+
+// tags clients can search and list by, mapped to AudioData columns
+var tagColumns = map[string]string{
+	"artist":      "artists",
+	"albumartist": "album_artist",
+	"album":       "album",
+	"title":       "title",
+	"genre":       "genre",
+	"date":        "year",
+	"composer":    "composer",
+	"track":       "track_num",
+	"disc":        "disc_num",
+}
+
+// how tag names are written in responses
+var tagNames = map[string]string{
+	"artist":      "Artist",
+	"albumartist": "AlbumArtist",
+	"album":       "Album",
+	"title":       "Title",
+	"genre":       "Genre",
+	"date":        "Date",
+	"composer":    "Composer",
+	"track":       "Track",
+	"disc":        "Disc",
+}
+
+// the columns "any" looks through
+var anyColumns = []string{"title", "artists", "album", "album_artist", "composer", "genre", "path"}
+
+// a WHERE clause and its arguments
+type filter struct {
+	clauses []string
+	args    []any
+}
+
+func (f *filter) add(clause string, args ...any) {
+	f.clauses = append(f.clauses, clause)
+	f.args = append(f.args, args...)
+}
+
+func (f *filter) where() string {
+	return strings.Join(f.clauses, " AND ")
+}
+
+func (f *filter) empty() bool {
+	return len(f.clauses) == 0
+}
+
+// builds a condition on one tag, fold makes it case insensitive like search is
+func (c *conn) tagCondition(tag, op, value string, fold bool) (string, []any, error) {
+	tag = strings.ToLower(tag)
+	var columns []string
+	switch tag {
+	case "any":
+		columns = anyColumns
+	case "file":
+		columns = []string{"path"}
+		value = c.s.absPath(value)
+	default:
+		column, ok := tagColumns[tag]
+		if !ok {
+			return "", nil, ack(ackErrorArg, "Unknown tag type: %s", tag)
+		}
+		columns = []string{column}
+	}
+
+	var conditions []string
+	var args []any
+	for _, column := range columns {
+		// numbers are compared as text, the same as MPD does
+		expr := "CAST(" + column + " AS TEXT)"
+		param := "?"
+		if fold {
+			expr = "LOWER(" + expr + ")"
+			param = "LOWER(?)"
+		}
+		switch op {
+		case "==":
+			conditions = append(conditions, expr+" = "+param)
+		case "!=":
+			conditions = append(conditions, "("+column+" IS NULL OR "+expr+" != "+param+")")
+		case "contains":
+			conditions = append(conditions, "INSTR("+expr+", "+param+") > 0")
+		case "starts_with":
+			conditions = append(conditions, "INSTR("+expr+", "+param+") = 1")
+		default:
+			return "", nil, ack(ackErrorArg, "Unknown filter operator: %s", op)
+		}
+		args = append(args, value)
+	}
+	if op == "!=" {
+		return "(" + strings.Join(conditions, " AND ") + ")", args, nil
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args, nil
+}
+
+// the old TAG VALUE pairs or a filter expression, search matches substrings case insensitively and find matches exactly
+func (c *conn) parseFilter(args []string, search bool) (*filter, error) {
+	f := &filter{}
+	if len(args) == 1 && strings.HasPrefix(args[0], "(") {
+		p := &expressionParser{c: c, s: args[0], fold: search}
+		clause, params, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(p.s[p.pos:]) != "" {
+			return nil, ack(ackErrorArg, "Unparsed garbage after expression.")
+		}
+		f.add(clause, params...)
+		return f, nil
+	}
+	if len(args)%2 != 0 {
+		return nil, ack(ackErrorArg, "Incorrect number of filter arguments.")
+	}
+	op := "=="
+	if search {
+		op = "contains"
+	}
+	for i := 0; i < len(args); i += 2 {
+		clause, params, err := c.tagCondition(args[i], op, args[i+1], search)
+		if err != nil {
+			return nil, err
+		}
+		f.add(clause, params...)
+	}
+	return f, nil
+}
+
+// MPD's filter syntax, e.g. ((artist == 'Foo') AND (album contains 'bar'))
+type expressionParser struct {
+	c    *conn
+	s    string
+	pos  int
+	fold bool
+}
+
+func (p *expressionParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *expressionParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *expressionParser) expect(c byte) error {
+	if p.peek() != c {
+		return ack(ackErrorArg, "'%c' expected in filter expression.", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *expressionParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(" \t()'\"=!", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// == and != don't need spaces around them
+func (p *expressionParser) operator() string {
+	p.skipSpace()
+	if rest := p.s[p.pos:]; strings.HasPrefix(rest, "==") || strings.HasPrefix(rest, "!=") || strings.HasPrefix(rest, "=~") {
+		p.pos += 2
+		return rest[:2]
+	}
+	return p.word()
+}
+
+func (p *expressionParser) quoted() (string, error) {
+	quote := p.peek()
+	if quote != '\'' && quote != '"' {
+		return "", ack(ackErrorArg, "Quoted string expected in filter expression.")
+	}
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		if c == '\\' && p.pos < len(p.s) {
+			sb.WriteByte(p.s[p.pos])
+			p.pos++
+		} else if c == quote {
+			return sb.String(), nil
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return "", errUnterminatedQuote
+}
+
+func (p *expressionParser) parse() (string, []any, error) {
+	if err := p.expect('('); err != nil {
+		return "", nil, err
+	}
+
+	switch p.peek() {
+	case '(':
+		var clauses []string
+		var args []any
+		for {
+			clause, params, err := p.parse()
+			if err != nil {
+				return "", nil, err
+			}
+			clauses = append(clauses, clause)
+			args = append(args, params...)
+			if p.peek() == ')' {
+				p.pos++
+				return "(" + strings.Join(clauses, " AND ") + ")", args, nil
+			}
+			if p.word() != "AND" {
+				return "", nil, ack(ackErrorArg, "'AND' expected in filter expression.")
+			}
+		}
+	case '!':
+		p.pos++
+		clause, args, err := p.parse()
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT " + clause, args, p.expect(')')
+	}
+
+	tag := p.word()
+	if tag == "base" {
+		value, err := p.quoted()
+		if err != nil {
+			return "", nil, err
+		}
+		prefix := p.c.s.absPath(value) + "/"
+		return "(SUBSTR(path, 1, LENGTH(?)) = ?)", []any{prefix, prefix}, p.expect(')')
+	}
+	op := p.operator()
+	value, err := p.quoted()
+	if err != nil {
+		return "", nil, err
+	}
+	clause, args, err := p.c.tagCondition(tag, op, value, p.fold)
+	if err != nil {
+		return "", nil, err
+	}
+	return clause, args, p.expect(')')
+}
@@ -0,0 +1,153 @@
+package mpd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the protocol version we claim to speak, clients use it to decide which commands to send
+const protocolVersion = "0.23.0"
+
+// error codes from MPD's ack.h
+const (
+	ackErrorNotList    = 1
+	ackErrorArg        = 2
+	ackErrorPassword   = 3
+	ackErrorPermission = 4
+	ackErrorUnknown    = 5
+	ackErrorNoExist    = 50
+	ackErrorSystem     = 52
+	ackErrorPlayerSync = 55
+)
+
+var errUnterminatedQuote = errors.New("Unterminated quote.")
+
+type ackError struct {
+	code    int
+	message string
+}
+
+func (e *ackError) Error() string {
+	return e.message
+}
+
+func ack(code int, format string, args ...any) *ackError {
+	return &ackError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// splits a command line into words, double quoted words can contain spaces and backslash escapes
+func parseArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+		var sb strings.Builder
+		closed := false
+		i := 1
+		for ; i < len(line); i++ {
+			c := line[i]
+			if c == '\\' && i+1 < len(line) {
+				i++
+				sb.WriteByte(line[i])
+			} else if c == '"' {
+				closed = true
+				break
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+		if !closed {
+			return nil, errUnterminatedQuote
+		}
+		args = append(args, sb.String())
+		line = line[i+1:]
+	}
+}
+
+// START:END or a single position, END is exclusive and can be left out to mean the end of the playlist
+func parseRange(s string, length int) (int, int, error) {
+	startStr, endStr, isRange := strings.Cut(s, ":")
+	start, err := strconv.Atoi(startStr)
+	if err != nil || start < 0 {
+		return 0, 0, ack(ackErrorArg, "Integer or range expected: %s", s)
+	}
+	if !isRange {
+		return start, start + 1, nil
+	}
+	end := length
+	if endStr != "" {
+		if end, err = strconv.Atoi(endStr); err != nil || end < start {
+			return 0, 0, ack(ackErrorArg, "Integer or range expected: %s", s)
+		}
+	}
+	return start, end, nil
+}
+
+func parseInt(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, ack(ackErrorArg, "Integer expected: %s", s)
+	}
+	return n, nil
+}
+
+func parseBool(s string) (bool, error) {
+	switch s {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return false, ack(ackErrorArg, "Boolean (0/1) expected: %s", s)
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds < 0 {
+		return 0, ack(ackErrorArg, "Number expected: %s", s)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// buffers one response, it's only flushed once the whole command has run
+type response struct {
+	w *bufio.Writer
+}
+
+func (r *response) field(key string, value any) {
+	fmt.Fprintf(r.w, "%s: %v\n", key, value)
+}
+
+// skips fields that aren't set
+func (r *response) optional(key string, value *string) {
+	if value != nil && *value != "" {
+		r.field(key, *value)
+	}
+}
+
+func (r *response) optionalInt(key string, value *int) {
+	if value != nil {
+		r.field(key, *value)
+	}
+}
+
+func (r *response) binary(data []byte) {
+	r.field("binary", len(data))
+	r.w.Write(data)
+	r.w.WriteByte('\n')
+}
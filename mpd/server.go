@@ -0,0 +1,376 @@
+package mpd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"gorm.io/gorm"
+)
+
+// the default chunk size for albumart and readpicture
+const defaultBinaryLimit = 8192
+
+var ErrServerClosed = errors.New("MPD server closed.")
+
+var ErrNoPassword = errors.New("MPD needs a password when it doesn't listen on loopback.")
+
+type Server struct {
+	mp        *bot.MusicPlayer
+	db        *gorm.DB
+	addr      string
+	musicPath string
+	password  string
+	started   time.Time
+	listener  net.Listener
+	conns     map[net.Conn]struct{}
+	closed    bool
+	mu        sync.Mutex
+}
+
+// file names are given to clients relative to musicPath, like MPD's music_directory
+func CreateServer(addr, musicPath string, mp *bot.MusicPlayer, db *gorm.DB) *Server {
+	// the scanner stores absolute paths
+	if abs, err := filepath.Abs(musicPath); err == nil {
+		musicPath = abs
+	}
+	return &Server{
+		mp:        mp,
+		db:        db,
+		addr:      addr,
+		musicPath: musicPath,
+		started:   time.Now(),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// clients have to send the password before anything else works,
+// no password lets everyone in so it's only allowed on loopback
+func (s *Server) SetPassword(password string) {
+	s.password = password
+}
+
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	if s.password == "" && !isLoopback(listener.Addr()) {
+		listener.Close()
+		return ErrNoPassword
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(netConn) {
+			netConn.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(netConn)
+	}
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+func (s *Server) track(netConn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[netConn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(netConn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, netConn)
+}
+
+// stops listening and drops every client
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for netConn := range s.conns {
+		netConn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(netConn net.Conn) {
+	defer s.untrack(netConn)
+	defer netConn.Close()
+
+	c := &conn{
+		s:           s,
+		w:           bufio.NewWriter(netConn),
+		authorized:  s.password == "",
+		pending:     make(map[string]bool),
+		binaryLimit: defaultBinaryLimit,
+	}
+
+	// subscribing before the greeting means no change is missed between commands
+	events, unsubscribe := s.mp.Events().Subscribe()
+	defer unsubscribe()
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(netConn)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	fmt.Fprintf(c.w, "OK MPD %s\n", protocolVersion)
+	if c.w.Flush() != nil {
+		return
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok || !c.handleLine(line) {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			c.notify(event)
+		}
+		if err := c.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// file names relative to the music directory, or the whole path for tracks outside of it
+func (s *Server) fileURI(path string) string {
+	rel, err := filepath.Rel(s.musicPath, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (s *Server) absPath(uri string) string {
+	return filepath.Join(s.musicPath, filepath.FromSlash(strings.Trim(uri, "/")))
+}
+
+// changes whenever the contents or order of the playlist do
+func playlistVersion(playlist []bot.QueuedTrack) uint32 {
+	h := fnv.New32a()
+	for _, queued := range playlist {
+		fmt.Fprintf(h, "%d,", queued.ID)
+	}
+	fmt.Fprintf(h, "%d", len(playlist))
+	return h.Sum32()
+}
+
+type conn struct {
+	s           *Server
+	w           *bufio.Writer
+	authorized  bool
+	binaryLimit int
+	// command lists are collected until command_list_end
+	inList      bool
+	listOK      bool
+	commandList []string
+	// subsystems that changed since the client last asked, and the ones it's idling on
+	pending map[string]bool
+	idle    map[string]bool
+}
+
+// returns false when the connection should be closed
+func (c *conn) handleLine(line string) bool {
+	if c.idle != nil {
+		if strings.TrimSpace(line) != "noidle" {
+			// only noidle is allowed while idling
+			return false
+		}
+		c.idle = nil
+		c.w.WriteString("OK\n")
+		return true
+	}
+
+	if c.inList {
+		if strings.TrimSpace(line) != "command_list_end" {
+			c.commandList = append(c.commandList, line)
+			return true
+		}
+		list := c.commandList
+		c.inList = false
+		c.commandList = nil
+		for index, listLine := range list {
+			name, err := c.execute(listLine)
+			if errors.Is(err, errClose) {
+				return false
+			}
+			if err != nil {
+				c.writeAck(err, index, name)
+				return true
+			}
+			if c.listOK {
+				c.w.WriteString("list_OK\n")
+			}
+		}
+		c.w.WriteString("OK\n")
+		return true
+	}
+
+	switch strings.TrimSpace(line) {
+	case "command_list_begin", "command_list_ok_begin":
+		c.inList = true
+		c.listOK = strings.TrimSpace(line) == "command_list_ok_begin"
+		return true
+	}
+
+	args, err := parseArgs(line)
+	if err == nil && len(args) > 0 && args[0] == "idle" {
+		c.startIdle(args[1:])
+		return true
+	}
+
+	name, err := c.execute(line)
+	if errors.Is(err, errClose) {
+		return false
+	}
+	if err != nil {
+		c.writeAck(err, 0, name)
+		return true
+	}
+	c.w.WriteString("OK\n")
+	return true
+}
+
+func (c *conn) execute(line string) (string, error) {
+	args, err := parseArgs(line)
+	if err != nil {
+		return "", ack(ackErrorArg, "%s", err.Error())
+	}
+	if len(args) == 0 {
+		return "", ack(ackErrorUnknown, "No command given.")
+	}
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok {
+		return name, ack(ackErrorUnknown, "unknown command \"%s\"", name)
+	}
+	if !c.authorized && !cmd.public {
+		return name, ack(ackErrorPermission, "you don't have permission for \"%s\"", name)
+	}
+	args = args[1:]
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		return name, ack(ackErrorArg, "wrong number of arguments for \"%s\"", name)
+	}
+	return name, cmd.run(c, &response{w: c.w}, args)
+}
+
+func (c *conn) writeAck(err error, index int, name string) {
+	var ackErr *ackError
+	if !errors.As(err, &ackErr) {
+		log.Println("MPD command failed: ", err)
+		ackErr = ack(ackErrorSystem, "%s", err.Error())
+	}
+	fmt.Fprintf(c.w, "ACK [%d@%d] {%s} %s\n", ackErr.code, index, name, ackErr.message)
+}
+
+var subsystems = []string{"player", "playlist", "options"}
+
+func subsystemFor(event bot.Event) string {
+	switch event.(type) {
+	case bot.TrackStartedEvent, bot.TrackFinishedEvent, bot.TrackSkippedEvent, bot.PlaybackStoppedEvent,
+		bot.PausedEvent, bot.ResumedEvent, bot.PlaybackErrorEvent:
+		return "player"
+	case bot.QueueChangedEvent:
+		return "playlist"
+	case bot.ModeChangedEvent:
+		return "options"
+	}
+	return ""
+}
+
+// no subsystems means all of them
+func (c *conn) startIdle(names []string) {
+	if !c.authorized {
+		c.writeAck(ack(ackErrorPermission, "you don't have permission for \"idle\""), 0, "idle")
+		return
+	}
+	c.idle = make(map[string]bool)
+	if len(names) == 0 {
+		names = subsystems
+	}
+	for _, name := range names {
+		c.idle[strings.ToLower(name)] = true
+	}
+	c.flushIdle()
+}
+
+func (c *conn) notify(event bot.Event) {
+	if subsystem := subsystemFor(event); subsystem != "" {
+		c.pending[subsystem] = true
+		c.flushIdle()
+	}
+}
+
+// ends the idle command if something the client is waiting for has changed
+func (c *conn) flushIdle() {
+	if c.idle == nil {
+		return
+	}
+	changed := false
+	for _, subsystem := range subsystems {
+		if c.idle[subsystem] && c.pending[subsystem] {
+			fmt.Fprintf(c.w, "changed: %s\n", subsystem)
+			delete(c.pending, subsystem)
+			changed = true
+		}
+	}
+	if changed {
+		c.idle = nil
+		c.w.WriteString("OK\n")
+	}
+}
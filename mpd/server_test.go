@@ -0,0 +1,322 @@
+package mpd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EricZhang456/mumble-music-bot/bot"
+	"github.com/EricZhang456/mumble-music-bot/internal/testutil"
+	"github.com/EricZhang456/mumble-music-bot/media"
+)
+
+// password is set before the server starts, empty for none
+func newTestServer(t *testing.T, password string) (*Server, *bot.MusicPlayer) {
+	t.Helper()
+	duration := 3*time.Minute + 30*time.Second
+	player := testutil.NewPlayer(t,
+		media.AudioData{Path: "/music/First Band/Letters/01 Alpha.flac", Title: "Alpha", Artists: testutil.StrPtr("First Band"), Album: testutil.StrPtr("Letters"), Year: testutil.IntPtr(2001), TrackNum: testutil.IntPtr(1), Duration: &duration},
+		media.AudioData{Path: "/music/First Band/Letters/02 Bravo.flac", Title: "Bravo", Artists: testutil.StrPtr("First Band"), Album: testutil.StrPtr("Letters"), Year: testutil.IntPtr(2001), TrackNum: testutil.IntPtr(2)},
+		media.AudioData{Path: "/music/Second Band/Charlie.flac", Title: "Charlie", Artists: testutil.StrPtr("Second Band"), Album: testutil.StrPtr("Numbers"), Genre: testutil.StrPtr("Jazz")},
+		media.AudioData{Path: "/music/loose.mp3", Title: "Loose Track"},
+	)
+	db, mp := player.DB, player.MusicPlayer
+
+	s := CreateServer("", "/music/", mp, db)
+	s.SetPassword(password)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = listener.Addr().String()
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+	return s, mp
+}
+
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, s *Server) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	if greeting := c.readLine(t); !strings.HasPrefix(greeting, "OK MPD ") {
+		t.Fatalf("unexpected greeting: %q", greeting)
+	}
+	return c
+}
+
+func (c *testClient) readLine(t *testing.T) string {
+	t.Helper()
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// the response lines without the final OK, or the ACK line
+func (c *testClient) read(t *testing.T) ([]string, string) {
+	t.Helper()
+	var lines []string
+	for {
+		line := c.readLine(t)
+		if line == "OK" {
+			return lines, ""
+		}
+		if strings.HasPrefix(line, "ACK ") {
+			return lines, line
+		}
+		lines = append(lines, line)
+	}
+}
+
+func (c *testClient) send(t *testing.T, command string) []string {
+	t.Helper()
+	fmt.Fprintln(c.conn, command)
+	lines, ackLine := c.read(t)
+	if ackLine != "" {
+		t.Fatalf("%s failed: %s", command, ackLine)
+	}
+	return lines
+}
+
+func (c *testClient) sendAck(t *testing.T, command string) string {
+	t.Helper()
+	fmt.Fprintln(c.conn, command)
+	_, ackLine := c.read(t)
+	if ackLine == "" {
+		t.Fatalf("expected %s to fail", command)
+	}
+	return ackLine
+}
+
+// the values of one key in a response
+func values(lines []string, key string) []string {
+	var found []string
+	for _, line := range lines {
+		if k, v, ok := strings.Cut(line, ": "); ok && k == key {
+			found = append(found, v)
+		}
+	}
+	return found
+}
+
+func TestParseArgs(t *testing.T) {
+	args, err := parseArgs(`find artist "First \"Band\"" album Letters`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"find", "artist", `First "Band"`, "album", "Letters"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("got %q, want %q", args, want)
+	}
+	if _, err := parseArgs(`find "unterminated`); err == nil {
+		t.Error("expected an error for an unterminated quote")
+	}
+}
+
+func TestQueue(t *testing.T) {
+	s, mp := newTestServer(t, "")
+	c := dial(t, s)
+
+	c.send(t, `add "First Band"`)
+	c.send(t, `add loose.mp3`)
+	if got := values(c.send(t, "playlistinfo"), "Title"); !reflect.DeepEqual(got, []string{"Alpha", "Bravo", "Loose Track"}) {
+		t.Errorf("unexpected playlist: %v", got)
+	}
+	if id := values(c.send(t, `addid "Second Band/Charlie.flac" 0`), "Id"); !reflect.DeepEqual(id, []string{"4"}) {
+		t.Errorf("unexpected id: %v", id)
+	}
+	c.send(t, "move 0:2 2")
+	if got := values(c.send(t, "playlistinfo"), "Title"); !reflect.DeepEqual(got, []string{"Bravo", "Loose Track", "Charlie", "Alpha"}) {
+		t.Errorf("unexpected playlist after move: %v", got)
+	}
+	// ids follow the song around
+	moved := c.send(t, "playlistid 4")
+	if got := values(moved, "Title"); !reflect.DeepEqual(got, []string{"Charlie"}) {
+		t.Errorf("unexpected song for id 4: %v", got)
+	}
+	if got := values(moved, "Pos"); !reflect.DeepEqual(got, []string{"2"}) {
+		t.Errorf("unexpected position for id 4: %v", got)
+	}
+	c.send(t, "delete 1:3")
+	if got := values(c.send(t, "playlistinfo"), "file"); !reflect.DeepEqual(got, []string{"First Band/Letters/02 Bravo.flac", "First Band/Letters/01 Alpha.flac"}) {
+		t.Errorf("unexpected playlist after delete: %v", got)
+	}
+	if len(mp.GetPlaylist()) != 2 {
+		t.Errorf("the player's playlist wasn't changed")
+	}
+	if ackLine := c.sendAck(t, "deleteid 4"); !strings.HasPrefix(ackLine, "ACK [50@0] {deleteid}") {
+		t.Errorf("unexpected error: %s", ackLine)
+	}
+	c.send(t, "deleteid 2")
+	if got := values(c.send(t, "playlistinfo"), "Title"); !reflect.DeepEqual(got, []string{"Alpha"}) {
+		t.Errorf("unexpected playlist after deleteid: %v", got)
+	}
+	if ackLine := c.sendAck(t, "add nowhere"); !strings.HasPrefix(ackLine, "ACK [50@0] {add}") {
+		t.Errorf("unexpected error: %s", ackLine)
+	}
+	if ackLine := c.sendAck(t, "delete 5"); !strings.HasPrefix(ackLine, "ACK [2@0] {delete}") {
+		t.Errorf("unexpected error: %s", ackLine)
+	}
+
+	status := c.send(t, "status")
+	if got := values(status, "state"); !reflect.DeepEqual(got, []string{"stop"}) {
+		t.Errorf("unexpected state: %v", got)
+	}
+	if got := values(status, "playlistlength"); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("unexpected playlist length: %v", got)
+	}
+	version := values(status, "playlist")[0]
+	if changes := c.send(t, "plchanges "+version); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+	c.send(t, "clear")
+	if got := values(c.send(t, "status"), "playlist"); got[0] == version {
+		t.Error("the playlist version didn't change")
+	}
+}
+
+func TestModes(t *testing.T) {
+	s, mp := newTestServer(t, "")
+	c := dial(t, s)
+
+	c.send(t, "random 1")
+	c.send(t, "repeat 1")
+	if mp.GetMode() != bot.ShuffleRepeat {
+		t.Errorf("expected ShuffleRepeat, got %s", bot.PlaybackModeToString(mp.GetMode()))
+	}
+	c.send(t, "random 0")
+	status := c.send(t, "status")
+	if values(status, "random")[0] != "0" || values(status, "repeat")[0] != "1" || mp.GetMode() != bot.Repeat {
+		t.Errorf("unexpected status: %v", status)
+	}
+}
+
+func TestSearchAndList(t *testing.T) {
+	s, _ := newTestServer(t, "")
+	c := dial(t, s)
+
+	if got := values(c.send(t, "search artist band"), "Title"); len(got) != 3 {
+		t.Errorf("expected 3 tracks, got %v", got)
+	}
+	if got := values(c.send(t, "find artist band"), "Title"); len(got) != 0 {
+		t.Errorf("find should match exactly, got %v", got)
+	}
+	if got := values(c.send(t, `find "((artist == 'First Band') AND (title != 'Alpha'))"`), "Title"); !reflect.DeepEqual(got, []string{"Bravo"}) {
+		t.Errorf("unexpected tracks: %v", got)
+	}
+	if got := values(c.send(t, `search "(any contains 'charlie')" window 0:1`), "Title"); !reflect.DeepEqual(got, []string{"Charlie"}) {
+		t.Errorf("unexpected tracks: %v", got)
+	}
+	if got := values(c.send(t, `search "(base 'First Band')" sort -title`), "Title"); !reflect.DeepEqual(got, []string{"Bravo", "Alpha"}) {
+		t.Errorf("unexpected tracks: %v", got)
+	}
+
+	if got := values(c.send(t, "list artist"), "Artist"); !reflect.DeepEqual(got, []string{"First Band", "Second Band"}) {
+		t.Errorf("unexpected artists: %v", got)
+	}
+	if got := values(c.send(t, `list album "Second Band"`), "Album"); !reflect.DeepEqual(got, []string{"Numbers"}) {
+		t.Errorf("unexpected albums: %v", got)
+	}
+	grouped := c.send(t, "list album group artist")
+	want := []string{"Artist: First Band", "Album: Letters", "Artist: Second Band", "Album: Numbers"}
+	if !reflect.DeepEqual(grouped, want) {
+		t.Errorf("got %v, want %v", grouped, want)
+	}
+	if got := values(c.send(t, "list date"), "Date"); !reflect.DeepEqual(got, []string{"2001"}) {
+		t.Errorf("unexpected dates: %v", got)
+	}
+
+	root := c.send(t, "lsinfo")
+	if got := values(root, "directory"); !reflect.DeepEqual(got, []string{"First Band", "Second Band"}) {
+		t.Errorf("unexpected directories: %v", got)
+	}
+	if got := values(root, "file"); !reflect.DeepEqual(got, []string{"loose.mp3"}) {
+		t.Errorf("unexpected files: %v", got)
+	}
+	if got := values(c.send(t, `lsinfo "First Band"`), "directory"); !reflect.DeepEqual(got, []string{"First Band/Letters"}) {
+		t.Errorf("unexpected directories: %v", got)
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	s, _ := newTestServer(t, "")
+	c := dial(t, s)
+
+	fmt.Fprint(c.conn, "command_list_ok_begin\nadd loose.mp3\nstatus\ncommand_list_end\n")
+	lines, ackLine := c.read(t)
+	if ackLine != "" || lines[0] != "list_OK" || lines[len(lines)-1] != "list_OK" {
+		t.Errorf("unexpected response: %v %s", lines, ackLine)
+	}
+
+	fmt.Fprint(c.conn, "command_list_begin\nadd loose.mp3\nfrobnicate\nadd loose.mp3\ncommand_list_end\n")
+	if _, ackLine := c.read(t); !strings.HasPrefix(ackLine, "ACK [5@1] {frobnicate}") {
+		t.Errorf("unexpected error: %s", ackLine)
+	}
+	if got := values(c.send(t, "playlistinfo"), "Title"); len(got) != 2 {
+		t.Errorf("the list should have stopped at the error, got %v", got)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	s, _ := newTestServer(t, "")
+	idler := dial(t, s)
+	other := dial(t, s)
+
+	fmt.Fprintln(idler.conn, "idle playlist")
+	other.send(t, "add loose.mp3")
+	if lines, _ := idler.read(t); !reflect.DeepEqual(lines, []string{"changed: playlist"}) {
+		t.Errorf("unexpected idle response: %v", lines)
+	}
+
+	// changes made while the client wasn't idling are reported straight away
+	other.send(t, "repeat 1")
+	if lines := idler.send(t, "idle"); !reflect.DeepEqual(lines, []string{"changed: options"}) {
+		t.Errorf("unexpected idle response: %v", lines)
+	}
+
+	fmt.Fprintln(idler.conn, "idle player")
+	if lines := idler.send(t, "noidle"); len(lines) != 0 {
+		t.Errorf("unexpected noidle response: %v", lines)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	s, _ := newTestServer(t, "secret")
+	c := dial(t, s)
+
+	c.send(t, "ping")
+	if ackLine := c.sendAck(t, "status"); !strings.HasPrefix(ackLine, "ACK [4@0] {status}") {
+		t.Errorf("unexpected error: %s", ackLine)
+	}
+	if ackLine := c.sendAck(t, "password wrong"); !strings.HasPrefix(ackLine, "ACK [3@0] {password}") {
+		t.Errorf("unexpected error: %s", ackLine)
+	}
+	c.send(t, "password secret")
+	c.send(t, "status")
+}
+
+func TestNoPasswordOffLoopback(t *testing.T) {
+	s := CreateServer("", "/music/", nil, nil)
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(listener); err != ErrNoPassword {
+		t.Errorf("expected ErrNoPassword, got %v", err)
+	}
+}
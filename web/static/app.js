@@ -0,0 +1,437 @@
+"use strict";
+
+const pageSize = 50;
+
+const state = {
+	token: localStorage.getItem("token") || "",
+	status: null,
+	statusTime: 0,
+	query: "",
+	libraryOffset: 0,
+	queue: { tracks: [], current_index: -1 },
+	socket: null,
+	reconnectDelay: 1000,
+};
+
+const $ = (id) => document.getElementById(id);
+
+class UnauthorizedError extends Error {}
+
+async function api(method, path, body) {
+	const options = { method, headers: { Authorization: "Bearer " + state.token } };
+	if (body !== undefined) {
+		options.headers["Content-Type"] = "application/json";
+		options.body = JSON.stringify(body);
+	}
+	const response = await fetch(path, options);
+	if (response.status === 401) {
+		showLogin();
+		throw new UnauthorizedError("Missing or invalid API token.");
+	}
+	const data = await response.json();
+	if (!response.ok) {
+		throw new Error(data.error || response.statusText);
+	}
+	return data;
+}
+
+// for buttons, errors are shown instead of thrown
+function action(fn) {
+	return async (...args) => {
+		try {
+			await fn(...args);
+		} catch (err) {
+			if (!(err instanceof UnauthorizedError)) {
+				showError(err.message);
+			}
+		}
+	};
+}
+
+let toastTimer;
+function showError(message) {
+	const toast = $("toast");
+	toast.textContent = message;
+	toast.hidden = false;
+	clearTimeout(toastTimer);
+	toastTimer = setTimeout(() => (toast.hidden = true), 4000);
+}
+
+function showLogin() {
+	const dialog = $("login");
+	if (!dialog.open) {
+		$("token").value = state.token;
+		dialog.showModal();
+	}
+}
+
+function formatTime(ms) {
+	const seconds = Math.floor(ms / 1000);
+	const minutes = Math.floor(seconds / 60);
+	const hours = Math.floor(minutes / 60);
+	const pad = (n) => String(n).padStart(2, "0");
+	if (hours > 0) {
+		return `${hours}:${pad(minutes % 60)}:${pad(seconds % 60)}`;
+	}
+	return `${minutes}:${pad(seconds % 60)}`;
+}
+
+// covers are named by hash and never change, so each one is fetched once
+const covers = new Map();
+
+// the token goes in a header, not the URL, so covers are fetched and shown as blob URLs
+function coverURL(hash) {
+	if (!covers.has(hash)) {
+		const url = fetch(`/api/covers/${hash}`, { headers: { Authorization: "Bearer " + state.token } }).then(
+			async (response) => {
+				if (!response.ok) {
+					throw new Error(response.statusText);
+				}
+				return URL.createObjectURL(await response.blob());
+			},
+		);
+		// failed covers are tried again next time
+		url.catch(() => covers.delete(hash));
+		covers.set(hash, url);
+	}
+	return covers.get(hash);
+}
+
+function showCover(img, track) {
+	const hash = (track && track.cover_art) || "";
+	if (img.dataset.hash === hash) {
+		return;
+	}
+	img.dataset.hash = hash;
+	img.removeAttribute("src");
+	if (!hash) {
+		return;
+	}
+	coverURL(hash)
+		.then((url) => {
+			// a newer track might have taken the image while this one loaded
+			if (img.dataset.hash === hash) {
+				img.src = url;
+			}
+		})
+		.catch(() => {});
+}
+
+function subtitle(track) {
+	return [track.artists, track.album].filter(Boolean).join(" — ");
+}
+
+function element(tag, className, text) {
+	const el = document.createElement(tag);
+	if (className) {
+		el.className = className;
+	}
+	if (text !== undefined) {
+		el.textContent = text;
+	}
+	return el;
+}
+
+function trackRow(track) {
+	const li = element("li");
+	const cover = element("img", "cover");
+	cover.alt = "";
+	showCover(cover, track);
+	const info = element("div", "track-info");
+	info.append(element("div", "track-title", track.title), element("div", "track-subtitle", subtitle(track)));
+	li.append(cover, info);
+	if (track.duration_ms) {
+		li.append(element("span", "duration", formatTime(track.duration_ms)));
+	}
+	return li;
+}
+
+// library
+
+async function loadLibrary(append) {
+	if (!append) {
+		state.libraryOffset = 0;
+	}
+	const params = new URLSearchParams({ limit: pageSize, offset: state.libraryOffset });
+	let path = "/api/tracks?" + params;
+	if (state.query) {
+		params.set("q", state.query);
+		path = "/api/tracks/search?" + params;
+	}
+	const query = state.query;
+	const data = await api("GET", path);
+	// a newer search finished first
+	if (query !== state.query) {
+		return;
+	}
+	const list = $("library-list");
+	if (!append) {
+		list.replaceChildren();
+	}
+	for (const track of data.tracks) {
+		const li = trackRow(track);
+		li.title = "Double click to add to the queue";
+		li.ondblclick = action(() => addToQueue(track.id));
+		const add = element("button", null, "+");
+		add.title = "Add to queue";
+		add.onclick = action(() => addToQueue(track.id));
+		li.append(add);
+		list.append(li);
+	}
+	if (!append && data.tracks.length === 0) {
+		list.append(element("li", "empty", state.query ? "No tracks found." : "The library is empty."));
+	}
+	state.libraryOffset += data.tracks.length;
+	$("load-more").hidden = state.libraryOffset >= data.total;
+}
+
+async function addToQueue(id) {
+	renderQueue(await api("POST", "/api/queue", { track_id: id }));
+}
+
+// queue
+
+async function loadQueue() {
+	renderQueue(await api("GET", "/api/queue"));
+}
+
+function renderQueue(queue) {
+	state.queue = queue;
+	const list = $("queue-list");
+	list.replaceChildren();
+	queue.tracks.forEach((track, index) => {
+		const li = trackRow(track);
+		li.draggable = true;
+		li.dataset.index = index;
+		const playing = index === queue.current_index;
+		if (playing) {
+			li.classList.add("current");
+		}
+		const remove = element("button", null, "✕");
+		remove.title = playing ? "You can't remove the track that's currently playing." : "Remove from queue";
+		remove.disabled = playing;
+		remove.onclick = action(async () => renderQueue(await api("DELETE", `/api/queue/${index}`)));
+		li.append(remove);
+		addDragHandlers(li);
+		list.append(li);
+	});
+	$("queue-empty").hidden = queue.tracks.length > 0;
+	$("clear-queue").disabled = queue.tracks.length === 0;
+}
+
+let dragFrom = null;
+
+function clearDropMarkers() {
+	for (const li of $("queue-list").children) {
+		li.classList.remove("drop-before", "drop-after");
+	}
+}
+
+// dropping on the top half of a row puts the track before it, the bottom half after it
+function dropTarget(li, event) {
+	const rect = li.getBoundingClientRect();
+	const index = Number(li.dataset.index);
+	const after = event.clientY > rect.top + rect.height / 2;
+	let to = after ? index + 1 : index;
+	if (dragFrom < to) {
+		to--;
+	}
+	return { to, after };
+}
+
+function addDragHandlers(li) {
+	li.addEventListener("dragstart", (event) => {
+		dragFrom = Number(li.dataset.index);
+		event.dataTransfer.effectAllowed = "move";
+		event.dataTransfer.setData("text/plain", li.dataset.index);
+		li.classList.add("dragging");
+	});
+	li.addEventListener("dragend", () => {
+		dragFrom = null;
+		li.classList.remove("dragging");
+		clearDropMarkers();
+	});
+	li.addEventListener("dragover", (event) => {
+		if (dragFrom === null) {
+			return;
+		}
+		event.preventDefault();
+		const { after } = dropTarget(li, event);
+		clearDropMarkers();
+		li.classList.add(after ? "drop-after" : "drop-before");
+	});
+	li.addEventListener("drop", action(async (event) => {
+		event.preventDefault();
+		if (dragFrom === null) {
+			return;
+		}
+		const from = dragFrom;
+		const { to } = dropTarget(li, event);
+		clearDropMarkers();
+		if (from !== to) {
+			renderQueue(await api("POST", "/api/queue/move", { from, to }));
+		}
+	}));
+}
+
+// player
+
+async function loadStatus() {
+	renderStatus(await api("GET", "/api/status"));
+}
+
+function renderStatus(status) {
+	state.status = status;
+	state.statusTime = performance.now();
+	const track = status.track;
+	$("now-title").textContent = track ? track.title : "Not playing";
+	$("now-subtitle").textContent = track ? subtitle(track) : "";
+	const cover = $("now-cover");
+	cover.hidden = !track || !track.cover_art;
+	showCover(cover, track);
+	const playPause = $("play-pause");
+	const showPause = status.playing && !status.paused;
+	playPause.innerHTML = showPause ? "&#10074;&#10074;" : "&#9654;";
+	playPause.title = showPause ? "Pause" : "Play";
+	$("stop").disabled = !status.playing;
+	$("skip").disabled = !status.playing;
+	$("mode").value = status.mode;
+	renderProgress();
+}
+
+function currentPosition() {
+	const status = state.status;
+	if (!status || !status.playing) {
+		return 0;
+	}
+	let position = status.position_ms || 0;
+	if (!status.paused) {
+		position += performance.now() - state.statusTime;
+	}
+	const duration = status.track.duration_ms;
+	return duration ? Math.min(position, duration) : position;
+}
+
+function renderProgress() {
+	const status = state.status;
+	const duration = status && status.playing ? status.track.duration_ms : 0;
+	const position = currentPosition();
+	$("progress-bar").style.width = duration ? `${(position / duration) * 100}%` : "0";
+	if (!status || !status.playing) {
+		$("progress-time").textContent = "";
+	} else if (duration) {
+		$("progress-time").textContent = `${formatTime(position)} / ${formatTime(duration)}`;
+	} else {
+		$("progress-time").textContent = formatTime(position);
+	}
+}
+
+async function playPause() {
+	const status = state.status;
+	if (status && status.playing && !status.paused) {
+		renderStatus(await api("POST", "/api/playback/pause"));
+	} else {
+		renderStatus(await api("POST", "/api/playback/start"));
+	}
+}
+
+async function seek(event) {
+	const status = state.status;
+	if (!status || !status.playing || !status.track.duration_ms) {
+		return;
+	}
+	const rect = $("progress").getBoundingClientRect();
+	const fraction = Math.min(Math.max((event.clientX - rect.left) / rect.width, 0), 1);
+	const position = Math.round(fraction * status.track.duration_ms);
+	renderStatus(await api("POST", "/api/playback/seek", { position_ms: position }));
+}
+
+// events
+
+function connectEvents() {
+	if (state.socket) {
+		state.socket.onclose = null;
+		state.socket.close();
+	}
+	const protocol = location.protocol === "https:" ? "wss:" : "ws:";
+	const socket = new WebSocket(`${protocol}//${location.host}/api/events?token=${encodeURIComponent(state.token)}`);
+	state.socket = socket;
+	socket.onopen = () => {
+		state.reconnectDelay = 1000;
+	};
+	socket.onmessage = (message) => handleEvent(JSON.parse(message.data));
+	socket.onclose = () => {
+		state.socket = null;
+		setTimeout(connectEvents, state.reconnectDelay);
+		state.reconnectDelay = Math.min(state.reconnectDelay * 2, 30000);
+	};
+}
+
+const refresh = action(async (what) => {
+	await Promise.all(what.map((load) => load()));
+});
+
+function handleEvent(event) {
+	switch (event.type) {
+		case "status":
+			renderStatus(event.data);
+			refresh([loadQueue]);
+			break;
+		case "track_started":
+		case "playback_stopped":
+			refresh([loadStatus, loadQueue]);
+			break;
+		case "paused":
+		case "resumed":
+			refresh([loadStatus]);
+			break;
+		case "queue_changed":
+			refresh([loadQueue]);
+			break;
+		case "mode_changed":
+			$("mode").value = event.data.mode;
+			break;
+		case "playback_error":
+			showError(`Failed to play ${event.data.track ? event.data.track.title : "track"}: ${event.data.error}`);
+			break;
+	}
+}
+
+// setup
+
+async function start() {
+	await Promise.all([loadStatus(), loadQueue(), loadLibrary(false)]);
+	connectEvents();
+}
+
+$("login").addEventListener("close", () => {
+	state.token = $("token").value.trim();
+	localStorage.setItem("token", state.token);
+	action(start)();
+});
+
+let searchTimer;
+$("search").addEventListener("input", () => {
+	clearTimeout(searchTimer);
+	searchTimer = setTimeout(() => {
+		state.query = $("search").value.trim();
+		action(loadLibrary)(false);
+	}, 300);
+});
+$("load-more").onclick = action(() => loadLibrary(true));
+$("clear-queue").onclick = action(async () => renderQueue(await api("DELETE", "/api/queue")));
+$("play-pause").onclick = action(playPause);
+$("stop").onclick = action(async () => renderStatus(await api("POST", "/api/playback/stop")));
+$("skip").onclick = action(() => api("POST", "/api/playback/skip"));
+$("mode").onchange = action(async () => {
+	await api("PUT", "/api/mode", { mode: $("mode").value });
+});
+$("progress").onclick = action(seek);
+
+setInterval(renderProgress, 500);
+
+if (state.token) {
+	action(start)();
+} else {
+	showLogin();
+}